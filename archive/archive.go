@@ -2,10 +2,16 @@ package archive
 
 import (
 	"context"
+	"fmt"
 	"github.com/ipfs/go-cid"
 	"github.com/frawleyskid/ipfs-bib/config"
+	"github.com/frawleyskid/ipfs-bib/logging"
+	"github.com/frawleyskid/ipfs-bib/spool"
 	"github.com/frawleyskid/ipfs-bib/store"
 	"github.com/nickng/bibtex"
+	"os"
+	"path"
+	"strings"
 )
 
 const (
@@ -16,21 +22,46 @@ const (
 type BibCiteName = string
 
 type BibMetadata struct {
-	Entry    bibtex.BibEntry
-	Doi      *string
-	Contents *ContentMetadata
+	Entry      bibtex.BibEntry
+	Doi        *string
+	Contents   *ContentMetadata
+	Skipped    *LicenseError
+	OverBudget bool
+	Attempts   []Attempt
 }
 
 type BibContents struct {
 	Entry    bibtex.BibEntry
 	Doi      *string
 	Contents *DownloadedContent
+
+	// If every attachment of the entry is archived, these are the attachments
+	// other than the main source, which are stored alongside it.
+	Attachments []DownloadedContent
+
+	// If this entry was kept from the previous root passed to --update-from,
+	// this is where it is stored.
+	Previous *config.BibEntryLocation
+
+	// If a source was found for this entry but wasn't archived because of its
+	// license, this is why.
+	Skipped *LicenseError
+
+	// Whether this entry was skipped because the total size of the archive
+	// would have been over budget.
+	OverBudget bool
+
+	// These are the steps taken to find a source for this entry, in order.
+	Attempts []Attempt
 }
 
 func (c BibContents) ToMetadata() BibMetadata {
 	bibMetadata := BibMetadata{
-		Entry: c.Entry,
-		Doi:   c.Doi,
+		Entry:      c.Entry,
+		Doi:        c.Doi,
+		Skipped:    c.Skipped,
+		OverBudget: c.OverBudget,
+		Attempts:   c.Attempts,
 	}
 
 	if c.Contents != nil {
@@ -41,13 +72,62 @@ func (c BibContents) ToMetadata() BibMetadata {
 	return bibMetadata
 }
 
+// contentSize returns the total size of the sources to archive for this entry.
+func (c BibContents) contentSize() int64 {
+	var size int64
+
+	if c.Contents != nil {
+		size += c.Contents.Content.Size()
+	}
+
+	for _, attachment := range c.Attachments {
+		size += attachment.Content.Size()
+	}
+
+	return size
+}
+
+// removeContent removes the sources for this entry from the spool once they're
+// no longer needed.
+func (c BibContents) removeContent() {
+	if c.Contents != nil {
+		c.Contents.Content.Remove()
+	}
+
+	for _, attachment := range c.Attachments {
+		attachment.Content.Remove()
+	}
+}
+
+func (c *BibContents) record(attempt Attempt) {
+	c.Attempts = append(c.Attempts, attempt)
+}
+
+func (c BibContents) logNotArchived() {
+	switch {
+	case c.OverBudget:
+		logging.Error.Println(fmt.Sprintf("Skipped citation because the archive is over budget: %s", c.Entry.CiteName))
+	case c.Skipped != nil:
+		logging.Error.Println(fmt.Sprintf("Skipped citation because of its license: %s", c.Entry.CiteName))
+	case len(rejectedSources(c.Attempts)) > 0:
+		logging.Error.Println(fmt.Sprintf("Could not find a valid source for citation: %s", c.Entry.CiteName))
+	case hasTooLargeAttempt(c.Attempts):
+		logging.Error.Println(fmt.Sprintf("Could not find a source under the maximum file size for citation: %s", c.Entry.CiteName))
+	default:
+		logging.Error.Println(fmt.Sprintf("Could not find a source for citation: %s", c.Entry.CiteName))
+	}
+}
+
 type DownloadResult struct {
 	Contents BibContents
 	Error    error
 }
 
 type BibtexResult struct {
-	Bib   bibtex.BibTex
+	Bib bibtex.BibTex
+
+	// If the input was a CSL-JSON file, these are the original items.
+	Csl   *CslBibliography
 	Error error
 }
 
@@ -59,17 +139,26 @@ func newBibtexResultChan() chan BibtexResult {
 	return make(chan BibtexResult, oneshotChanSize)
 }
 
-func Load(ctx context.Context, cfg config.Config, input string) (chan BibtexResult, chan DownloadResult) {
+func Load(ctx context.Context, cfg config.Config, input string, journal *Journal, sourceStore store.SourceStore, sourceSpool *spool.Spool, budget *Budget) (chan BibtexResult, chan DownloadResult) {
 	bibResult := newBibtexResultChan()
 	downloadResult := newDownloadResultChan()
 
 	go func() {
-		if cfg.Flags.UseZotero {
-			FromZotero(ctx, cfg, input, bibResult, downloadResult)
+		previousSources, err := NewPreviousSources(cfg, sourceStore, journal)
+		if err != nil {
+			bibResult <- BibtexResult{Error: err}
+			downloadResult <- DownloadResult{Error: err}
+			return
+		}
+
+		if zoteroDataDir := cfg.Flags.MaybeZoteroLocal(); zoteroDataDir != nil {
+			FromZoteroLocal(ctx, cfg, *zoteroDataDir, input, journal, previousSources, budget, sourceSpool, bibResult, downloadResult)
+		} else if cfg.Flags.UseZotero {
+			FromZotero(ctx, cfg, input, journal, previousSources, budget, sourceSpool, bibResult, downloadResult)
 		} else {
-			bib, err := ParseBibtex(input)
+			bib, csl, err := ParseInput(cfg, input)
 			if err == nil {
-				bibResult <- BibtexResult{Bib: bib}
+				bibResult <- BibtexResult{Bib: bib, Csl: csl}
 				close(bibResult)
 			} else {
 				bibResult <- BibtexResult{Error: err}
@@ -77,7 +166,7 @@ func Load(ctx context.Context, cfg config.Config, input string) (chan BibtexResu
 				return
 			}
 
-			FromBibtex(ctx, cfg, bib, downloadResult)
+			FromBibtex(ctx, cfg, bib, journal, previousSources, budget, sourceSpool, downloadResult)
 		}
 	}()
 
@@ -87,9 +176,11 @@ func Load(ctx context.Context, cfg config.Config, input string) (chan BibtexResu
 type Location struct {
 	Root    cid.Cid
 	Entries map[BibCiteName]config.BibEntryLocation
+	Status  map[BibCiteName]EntryStatus
+	Removed []string
 }
 
-func Store(ctx context.Context, cfg config.Config, contents chan DownloadResult, sourceStore store.SourceStore) (Location, []BibMetadata, error) {
+func Store(ctx context.Context, cfg config.Config, contents chan DownloadResult, sourceStore store.SourceStore, journal *Journal, budget *Budget) (Location, []BibMetadata, error) {
 	// We may have multiple contents with the same bibtex cite name, so we need
 	// to deduplicate them by choosing the "best" contents for a given cite name.
 	deduplicatedContents := DeduplicateContents(contents)
@@ -100,36 +191,107 @@ func Store(ctx context.Context, cfg config.Config, contents chan DownloadResult,
 	}
 
 	locationMap := make(map[BibCiteName]config.BibEntryLocation)
+	statusMap := make(map[BibCiteName]EntryStatus)
+	currentDirectories := make(map[string]struct{})
 
 	var metadataList []BibMetadata //nolint:prealloc
 
 	for downloadResult := range deduplicatedContents {
 		if downloadResult.Error != nil {
-			return Location{}, nil, err
+			return Location{}, nil, downloadResult.Error
 		}
 
 		bibContent := downloadResult.Contents
 
+		// Every entry is given a directory in order, even if it has no source
+		// or was kept from the previous root, so that each entry gets the same
+		// directory its previous source was looked up in, and a kept directory
+		// is never given to another entry. This happens even when we're not
+		// updating a previous root, because an archive which is updated later
+		// must have given out its directories the same way.
+		sourcePathTemplate.Directory(bibContent.Entry)
+
+		if bibContent.Previous == nil && bibContent.Contents != nil && !budget.Spend(bibContent.contentSize()) {
+			bibContent.removeContent()
+			bibContent.Contents = nil
+			bibContent.Attachments = nil
+			bibContent.OverBudget = true
+			bibContent.logNotArchived()
+		}
+
 		metadataList = append(metadataList, bibContent.ToMetadata())
 
+		if bibContent.Previous != nil {
+			locationMap[bibContent.Entry.CiteName] = *bibContent.Previous
+			statusMap[bibContent.Entry.CiteName] = EntryStatusUnchanged
+			currentDirectories[bibContent.Previous.DirectoryName] = struct{}{}
+
+			continue
+		}
+
 		if bibContent.Contents == nil {
+			if err := journal.Record(bibContent, nil); err != nil {
+				return Location{}, nil, err
+			}
+
 			continue
 		}
 
 		sourcePath := sourcePathTemplate.Execute(bibContent.Entry, bibContent.Contents.FileName, bibContent.Contents.MediaType)
 
+		previousLocation, err := sourceStore.PreviousSource(ctx, sourcePath.DirectoryName)
+		if err != nil {
+			return Location{}, nil, err
+		}
+
+		sourceFiles, contentFiles, err := openSourceFiles(bibContent, sourcePath.FileName, sourcePathTemplate)
+		if err != nil {
+			return Location{}, nil, err
+		}
+
 		bibSource := config.BibSource{
-			Content:       bibContent.Contents.Content,
-			FileName:      sourcePath.FileName,
+			Files:         sourceFiles,
 			DirectoryName: sourcePath.DirectoryName,
 		}
 
 		entryLocation, err := sourceStore.AddSource(ctx, bibSource)
+
+		closeContentFiles(contentFiles)
+
 		if err != nil {
 			return Location{}, nil, err
 		}
 
 		locationMap[bibContent.Entry.CiteName] = entryLocation
+		currentDirectories[sourcePath.DirectoryName] = struct{}{}
+
+		if previousLocation == nil {
+			statusMap[bibContent.Entry.CiteName] = EntryStatusAdded
+		} else {
+			statusMap[bibContent.Entry.CiteName] = EntryStatusReplaced
+		}
+
+		if err := journal.Record(bibContent, &entryLocation); err != nil {
+			return Location{}, nil, err
+		}
+
+		bibContent.removeContent()
+	}
+
+	var removed []string
+
+	if cfg.Flags.Prune {
+		for _, directoryName := range sourceStore.PreviousSourceNames() {
+			if _, ok := currentDirectories[directoryName]; ok {
+				continue
+			}
+
+			if err := sourceStore.RemoveSource(ctx, directoryName); err != nil {
+				return Location{}, nil, err
+			}
+
+			removed = append(removed, directoryName)
+		}
 	}
 
 	rootCid, err := sourceStore.Finalize(ctx)
@@ -140,5 +302,68 @@ func Store(ctx context.Context, cfg config.Config, contents chan DownloadResult,
 	return Location{
 		Root:    rootCid,
 		Entries: locationMap,
+		Status:  statusMap,
+		Removed: removed,
 	}, metadataList, nil
 }
+
+// openSourceFiles opens the main source and each attachment of an entry. The
+// main source is named `mainFileName`, and the file name template is applied
+// to each attachment.
+func openSourceFiles(bibContent BibContents, mainFileName string, sourcePathTemplate config.SourcePathTemplate) ([]config.BibSourceFile, []*os.File, error) {
+	contents := append([]DownloadedContent{*bibContent.Contents}, bibContent.Attachments...)
+
+	sourceFiles := make([]config.BibSourceFile, 0, len(contents))
+	contentFiles := make([]*os.File, 0, len(contents))
+	fileNames := make(map[string]struct{}, len(contents))
+
+	for index, downloadedContent := range contents {
+		fileName := mainFileName
+		if index > 0 {
+			fileName = sourcePathTemplate.Execute(bibContent.Entry, downloadedContent.FileName, downloadedContent.MediaType).FileName
+		}
+
+		contentFile, err := downloadedContent.Content.Open()
+		if err != nil {
+			closeContentFiles(contentFiles)
+			return nil, nil, err
+		}
+
+		contentFiles = append(contentFiles, contentFile)
+		sourceFiles = append(sourceFiles, config.BibSourceFile{
+			Content:  contentFile,
+			FileName: uniqueFileName(fileName, fileNames),
+		})
+	}
+
+	return sourceFiles, contentFiles, nil
+}
+
+func closeContentFiles(contentFiles []*os.File) {
+	for _, contentFile := range contentFiles {
+		if err := contentFile.Close(); err != nil {
+			logging.Verbose.Println(err)
+		}
+	}
+}
+
+// uniqueFileName numbers a file name if another file in the same directory
+// already has it (e.g. `source-2.pdf`), and adds it to `fileNames`.
+func uniqueFileName(fileName string, fileNames map[string]struct{}) string {
+	extension := path.Ext(fileName)
+	stem := strings.TrimSuffix(fileName, extension)
+
+	uniqueName := fileName
+
+	for ordinal := 2; ; ordinal++ {
+		if _, ok := fileNames[uniqueName]; !ok {
+			break
+		}
+
+		uniqueName = fmt.Sprintf("%s-%d%s", stem, ordinal, extension)
+	}
+
+	fileNames[uniqueName] = struct{}{}
+
+	return uniqueName
+}
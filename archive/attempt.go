@@ -0,0 +1,158 @@
+package archive
+
+import (
+	"errors"
+	"github.com/frawleyskid/ipfs-bib/config"
+	"github.com/frawleyskid/ipfs-bib/handler"
+	"github.com/frawleyskid/ipfs-bib/network"
+	"github.com/frawleyskid/ipfs-bib/resolver"
+	"github.com/frawleyskid/ipfs-bib/spool"
+	"net/url"
+	"time"
+)
+
+// AttemptStep is the step in which we tried to find a source for an entry.
+// Steps which look up or download a source are named after the ContentOrigin
+// of the source, like `unpaywall` or `zotero`.
+type AttemptStep string
+
+const (
+	// The entry was checked for a URL, DOI or other identifier.
+	AttemptStepLocate AttemptStep = "locate"
+
+	// A resolver whose origin isn't known failed to look up a source.
+	AttemptStepResolve AttemptStep = "resolve"
+)
+
+type ErrorClass string
+
+const (
+	ErrorClassNoIdentifier      ErrorClass = "noIdentifier"
+	ErrorClassNotFound          ErrorClass = "notFound"
+	ErrorClassHttpStatus        ErrorClass = "httpStatus"
+	ErrorClassNetwork           ErrorClass = "network"
+	ErrorClassUnmarshal         ErrorClass = "unmarshal"
+	ErrorClassNotHandled        ErrorClass = "notHandled"
+	ErrorClassMonolith          ErrorClass = "monolith"
+	ErrorClassTooLarge          ErrorClass = "tooLarge"
+	ErrorClassInvalidContent    ErrorClass = "invalidContent"
+	ErrorClassLicenseNotAllowed ErrorClass = "licenseNotAllowed"
+	ErrorClassOther             ErrorClass = "other"
+)
+
+// Attempt records one step in finding a source for an entry, so that failures
+// can be reported.
+type Attempt struct {
+	Step AttemptStep
+
+	// The URL the source was downloaded from or looked up at, if known.
+	Url *url.URL
+
+	// This is nil if the step succeeded.
+	Err error
+
+	Duration time.Duration
+}
+
+func newAttempt(step AttemptStep, attemptUrl *url.URL, start time.Time, err error) Attempt {
+	return Attempt{
+		Step:     step,
+		Url:      attemptUrl,
+		Err:      err,
+		Duration: time.Since(start),
+	}
+}
+
+// MaybeUrl returns the URL of the attempt. If the attempt failed with an HTTP
+// status and the URL isn't otherwise known, this is the URL of the request.
+func (a Attempt) MaybeUrl() *url.URL {
+	if a.Url != nil {
+		return a.Url
+	}
+
+	statusErr := &network.HttpStatusError{}
+	if errors.As(a.Err, &statusErr) {
+		return &statusErr.Url
+	}
+
+	return nil
+}
+
+func (a Attempt) MaybeHttpStatus() *int {
+	statusErr := &network.HttpStatusError{}
+	if errors.As(a.Err, &statusErr) {
+		return &statusErr.StatusCode
+	}
+
+	return nil
+}
+
+func (a Attempt) MaybeErrorClass() *ErrorClass {
+	var errorClass ErrorClass
+
+	switch {
+	case a.Err == nil:
+		return nil
+	case errors.Is(a.Err, config.ErrCouldNotLocateEntry):
+		errorClass = ErrorClassNoIdentifier
+	case errors.Is(a.Err, ErrNoSource), errors.Is(a.Err, resolver.ErrNotResolved):
+		errorClass = ErrorClassNotFound
+	case a.MaybeHttpStatus() != nil:
+		errorClass = ErrorClassHttpStatus
+	case errors.Is(a.Err, network.ErrHttp):
+		errorClass = ErrorClassNetwork
+	case errors.Is(a.Err, network.ErrUnmarshalResponse):
+		errorClass = ErrorClassUnmarshal
+	case errors.Is(a.Err, handler.ErrNotHandled):
+		errorClass = ErrorClassNotHandled
+	case errors.Is(a.Err, handler.ErrMonolith):
+		errorClass = ErrorClassMonolith
+	case errors.Is(a.Err, spool.ErrTooLarge):
+		errorClass = ErrorClassTooLarge
+	case errors.Is(a.Err, handler.ErrInvalidContent):
+		errorClass = ErrorClassInvalidContent
+	case errors.Is(a.Err, ErrLicenseNotAllowed):
+		errorClass = ErrorClassLicenseNotAllowed
+	default:
+		errorClass = ErrorClassOther
+	}
+
+	return &errorClass
+}
+
+// MaybeValidationError returns why the content was rejected, if this attempt
+// failed validation.
+func (a Attempt) MaybeValidationError() *handler.ValidationError {
+	validationErr := &handler.ValidationError{}
+	if errors.As(a.Err, &validationErr) {
+		return validationErr
+	}
+
+	return nil
+}
+
+// rejectedSources returns the sources which were found but failed validation,
+// like PDFs which turned out to be login pages.
+func rejectedSources(attempts []Attempt) []handler.ValidationError {
+	var rejected []handler.ValidationError
+
+	for _, attempt := range attempts {
+		if validationErr := attempt.MaybeValidationError(); validationErr != nil {
+			rejected = append(rejected, *validationErr)
+		}
+	}
+
+	return rejected
+}
+
+// hasTooLargeAttempt returns whether any source was found but not archived
+// because it was larger than the maximum file size.
+func hasTooLargeAttempt(attempts []Attempt) bool {
+	for _, attempt := range attempts {
+		if errors.Is(attempt.Err, spool.ErrTooLarge) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,14 +1,15 @@
 package archive
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"github.com/frawleyskid/ipfs-bib/config"
 	"github.com/frawleyskid/ipfs-bib/logging"
 	"github.com/frawleyskid/ipfs-bib/network"
 	"github.com/frawleyskid/ipfs-bib/resolver"
+	"github.com/frawleyskid/ipfs-bib/spool"
 	"github.com/nickng/bibtex"
-	"io"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -28,34 +29,19 @@ const stdinFileName = "-"
 
 var ErrParseBibtex = errors.New("error parsing bibtex")
 
-func ParseBibtex(bibPath string) (bibtex.BibTex, error) {
-	var (
-		bibFile io.ReadCloser
-		err     error
-	)
-
-	if bibPath == stdinFileName {
-		bibFile = os.Stdin
-	} else {
-		bibFile, err = os.Open(bibPath)
-		if err != nil {
-			return bibtex.BibTex{}, err
-		}
-	}
-
-	bib, err := bibtex.Parse(bibFile)
+func ParseBibtex(content []byte) (bibtex.BibTex, error) {
+	bib, err := bibtex.Parse(bytes.NewReader(content))
 	if err != nil {
 		return bibtex.BibTex{}, fmt.Errorf("%w: %v", ErrParseBibtex, err)
 	}
 
-	if err := bibFile.Close(); err != nil {
-		return bibtex.BibTex{}, err
-	}
-
 	return *bib, nil
 }
 
-func ReadLocalBibSource(entry bibtex.BibEntry, includeSnapshots bool) (DownloadedContent, error) {
+// ReadLocalBibSource finds the first file in the `file` field of the entry
+// which exists. The file is read where it is rather than copied into the
+// spool.
+func ReadLocalBibSource(entry bibtex.BibEntry, includeSnapshots bool, sourceSpool *spool.Spool) (DownloadedContent, error) {
 	rawField := config.BibEntryField(entry, "file")
 	if rawField == nil {
 		return DownloadedContent{}, ErrNoSource
@@ -75,7 +61,7 @@ func ReadLocalBibSource(entry bibtex.BibEntry, includeSnapshots bool) (Downloade
 			continue
 		}
 
-		fileContent, err := os.ReadFile(bibFilePath)
+		fileContent, err := sourceSpool.Borrow(bibFilePath, bibMediaType)
 		if errors.Is(err, os.ErrNotExist) {
 			logging.Verbose.Println(fmt.Sprintf("Local source file does not exist: %s", bibFilePath))
 			continue
@@ -94,6 +80,7 @@ func ReadLocalBibSource(entry bibtex.BibEntry, includeSnapshots bool) (Downloade
 				MediaType: bibMediaType,
 				FileName:  bibFileName,
 				Origin:    ContentOriginLocal,
+				License:   config.EntryLicense(entry),
 			},
 		}, nil
 	}
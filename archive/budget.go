@@ -0,0 +1,85 @@
+package archive
+
+import (
+	"context"
+	"github.com/frawleyskid/ipfs-bib/config"
+	"github.com/nickng/bibtex"
+	"sync"
+)
+
+// Budget limits the total size of the sources added to the archive. Entries
+// are archived in order, and once a source doesn't fit, the budget is spent and
+// every remaining entry is skipped, so that which entries are archived doesn't
+// depend on their size. A nil *Budget is valid and has no limit.
+type Budget struct {
+	remaining int64
+	spent     bool
+	lock      sync.Mutex
+}
+
+func NewBudget(cfg config.Config) *Budget {
+	if cfg.File.Limit.MaxTotalSize <= 0 {
+		return nil
+	}
+
+	return &Budget{remaining: cfg.File.Limit.MaxTotalSize}
+}
+
+// Spent returns whether a source has already failed to fit in the budget.
+func (b *Budget) Spent() bool {
+	if b == nil {
+		return false
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.spent
+}
+
+// Spend takes the size of a source out of the budget, and returns false if it
+// doesn't fit.
+func (b *Budget) Spend(size int64) bool {
+	if b == nil {
+		return true
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.spent || size > b.remaining {
+		b.spent = true
+		return false
+	}
+
+	b.remaining -= size
+
+	return true
+}
+
+// wrap returns a download function which skips entries without downloading
+// them once the budget is spent. Since results are stored in order, the entries
+// it skips would have been skipped anyway.
+func (b *Budget) wrap(entryAt func(index int) bibtex.BibEntry, download downloadFunc) downloadFunc {
+	if b == nil {
+		return download
+	}
+
+	return func(ctx context.Context, index int) DownloadResult {
+		if !b.Spent() {
+			return download(ctx, index)
+		}
+
+		entry := entryAt(index)
+
+		skippedContents := BibContents{Entry: entry, OverBudget: true}
+
+		if locator, err := config.LocateEntry(entry); err == nil {
+			skippedContents.Doi = locator.Doi
+		}
+
+		skippedContents.logNotArchived()
+
+		return DownloadResult{Contents: skippedContents}
+	}
+}
@@ -0,0 +1,100 @@
+package archive
+
+import (
+	"fmt"
+	"golang.org/x/text/unicode/norm"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+const defaultCiteName = "entry"
+
+var yearRegex = regexp.MustCompile(`[0-9]{4}`)
+
+// These words are skipped when choosing a word from the title for a cite name.
+var citeNameStopWords = map[string]struct{}{
+	"a": {}, "an": {}, "the": {}, "of": {}, "on": {}, "in": {}, "and": {}, "for": {}, "to": {}, "with": {},
+}
+
+// citeNameGenerator generates cite names for formats which don't have them, in
+// the form `lastname_titleword_year` (e.g. `aspelmeyer_measured_2009`). Cite
+// names are made unique by adding a numeric suffix, so the same input always
+// produces the same cite names.
+type citeNameGenerator struct {
+	occurrenceCount map[string]int
+}
+
+func newCiteNameGenerator() *citeNameGenerator {
+	return &citeNameGenerator{occurrenceCount: make(map[string]int)}
+}
+
+// citeNamePart reduces a string to lowercase ASCII letters and digits.
+func citeNamePart(value string) string {
+	var builder strings.Builder
+
+	for _, char := range norm.NFKD.String(value) {
+		if char > unicode.MaxASCII {
+			continue
+		}
+
+		if unicode.IsLetter(char) || unicode.IsDigit(char) {
+			builder.WriteRune(unicode.ToLower(char))
+		}
+	}
+
+	return builder.String()
+}
+
+func firstTitleWord(title string) string {
+	for _, word := range strings.Fields(title) {
+		part := citeNamePart(word)
+		if part == "" {
+			continue
+		}
+
+		if _, isStopWord := citeNameStopWords[part]; !isStopWord {
+			return part
+		}
+	}
+
+	return ""
+}
+
+// lastName accepts a name either in the form `Last, First` or `First Last`.
+func lastName(name string) string {
+	if index := strings.Index(name, ","); index >= 0 {
+		return citeNamePart(name[:index])
+	}
+
+	fields := strings.Fields(name)
+	if len(fields) == 0 {
+		return ""
+	}
+
+	return citeNamePart(fields[len(fields)-1])
+}
+
+func (g *citeNameGenerator) generate(author, title, date string) string {
+	var parts []string
+
+	for _, part := range []string{lastName(author), firstTitleWord(title), yearRegex.FindString(date)} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	citeName := strings.Join(parts, "_")
+	if citeName == "" {
+		citeName = defaultCiteName
+	}
+
+	ordinal := g.occurrenceCount[citeName]
+	g.occurrenceCount[citeName] = ordinal + 1
+
+	if ordinal > 0 {
+		return fmt.Sprintf("%s_%d", citeName, ordinal+1)
+	}
+
+	return citeName
+}
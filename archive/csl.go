@@ -0,0 +1,556 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/frawleyskid/ipfs-bib/logging"
+	"github.com/nickng/bibtex"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	cslIdField     = "id"
+	cslTypeField   = "type"
+	cslUrlField    = "URL"
+	cslCustomField = "custom"
+	cslIpfsField   = "ipfs"
+)
+
+const defaultCslPermissions = 0644
+
+var (
+	ErrParseCslJson   = errors.New("error parsing CSL-JSON")
+	ErrMarshalCslJson = errors.New("error marshalling CSL-JSON")
+)
+
+// This maps CSL item types to bibtex entry types. Types which aren't listed
+// here become `misc` entries.
+var cslEntryTypes = map[string]string{
+	"article":           "article",
+	"article-journal":   "article",
+	"article-magazine":  "article",
+	"article-newspaper": "article",
+	"book":              "book",
+	"chapter":           "incollection",
+	"manuscript":        "unpublished",
+	"paper-conference":  "inproceedings",
+	"report":            "techreport",
+	"thesis":            "phdthesis",
+}
+
+// This maps bibtex entry types to CSL item types.
+var bibtexCslTypes = map[string]string{
+	"article":       "article-journal",
+	"book":          "book",
+	"incollection":  "chapter",
+	"inbook":        "chapter",
+	"inproceedings": "paper-conference",
+	"mastersthesis": "thesis",
+	"online":        "webpage",
+	"phdthesis":     "thesis",
+	"techreport":    "report",
+	"unpublished":   "manuscript",
+}
+
+// This maps CSL variables which are plain strings or numbers to bibtex fields.
+var cslBibtexFields = []struct {
+	csl    string
+	bibtex string
+}{
+	{"title", "title"},
+	{"volume", "volume"},
+	{"issue", "number"},
+	{"edition", "edition"},
+	{"publisher", "publisher"},
+	{"publisher-place", "address"},
+	{"collection-title", "series"},
+	{"DOI", "doi"},
+	{"URL", "url"},
+	{"ISBN", "isbn"},
+	{"ISSN", "issn"},
+	{"PMID", "pmid"},
+	{"PMCID", "pmcid"},
+	{"abstract", "abstract"},
+	{"note", "note"},
+	{"language", "language"},
+}
+
+type cslName struct {
+	Family              string `json:"family,omitempty"`
+	Given               string `json:"given,omitempty"`
+	NonDroppingParticle string `json:"non-dropping-particle,omitempty"`
+	Literal             string `json:"literal,omitempty"`
+}
+
+func (n cslName) String() string {
+	if n.Literal != "" {
+		return n.Literal
+	}
+
+	family := n.Family
+	if n.NonDroppingParticle != "" {
+		family = n.NonDroppingParticle + " " + family
+	}
+
+	if n.Given == "" {
+		return family
+	}
+
+	return family + ", " + n.Given
+}
+
+func parseBibtexName(name string) cslName {
+	name = strings.TrimSpace(name)
+
+	if index := strings.Index(name, ","); index >= 0 {
+		return cslName{Family: strings.TrimSpace(name[:index]), Given: strings.TrimSpace(name[index+1:])}
+	}
+
+	fields := strings.Fields(name)
+	if len(fields) < 2 {
+		return cslName{Literal: name}
+	}
+
+	return cslName{Family: fields[len(fields)-1], Given: strings.Join(fields[:len(fields)-1], " ")}
+}
+
+type cslDate struct {
+	DateParts [][]interface{} `json:"date-parts,omitempty"`
+	Raw       string          `json:"raw,omitempty"`
+	Literal   string          `json:"literal,omitempty"`
+}
+
+// String returns the date in the form `YYYY-MM-DD`, or as much of it as is
+// known.
+func (d cslDate) String() string {
+	if len(d.DateParts) == 0 || len(d.DateParts[0]) == 0 {
+		if d.Raw != "" {
+			return d.Raw
+		}
+
+		return d.Literal
+	}
+
+	parts := make([]string, 0, len(d.DateParts[0]))
+
+	for index, part := range d.DateParts[0] {
+		value := fmt.Sprint(part)
+
+		if index > 0 && len(value) == 1 {
+			value = "0" + value
+		}
+
+		parts = append(parts, value)
+	}
+
+	return strings.Join(parts, "-")
+}
+
+func parseBibtexDate(date string) cslDate {
+	var parts []interface{}
+
+	for _, part := range strings.Split(date, "-") {
+		number, err := strconv.Atoi(part)
+		if err != nil {
+			return cslDate{Raw: date}
+		}
+
+		parts = append(parts, number)
+	}
+
+	return cslDate{DateParts: [][]interface{}{parts}}
+}
+
+// CslItem is a single item in a CSL-JSON file. This preserves the order of
+// the item's fields, as well as any fields we don't understand, so that the
+// file can be written back with only the fields we've changed.
+type CslItem struct {
+	keys     []string
+	fields   map[string]json.RawMessage
+	citeName BibCiteName
+}
+
+func newCslItem() *CslItem {
+	return &CslItem{fields: make(map[string]json.RawMessage)}
+}
+
+func (i *CslItem) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+
+	if delim, ok := token.(json.Delim); !ok || delim != '{' {
+		return fmt.Errorf("%w: item must be an object", ErrParseCslJson)
+	}
+
+	i.fields = make(map[string]json.RawMessage)
+
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+
+		key, ok := token.(string)
+		if !ok {
+			return fmt.Errorf("%w: expected an object key", ErrParseCslJson)
+		}
+
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return err
+		}
+
+		if _, exists := i.fields[key]; !exists {
+			i.keys = append(i.keys, key)
+		}
+
+		i.fields[key] = value
+	}
+
+	return nil
+}
+
+func (i CslItem) MarshalJSON() ([]byte, error) {
+	var buffer bytes.Buffer
+
+	buffer.WriteByte('{')
+
+	for index, key := range i.keys {
+		if index > 0 {
+			buffer.WriteByte(',')
+		}
+
+		marshalledKey, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+
+		buffer.Write(marshalledKey)
+		buffer.WriteByte(':')
+		buffer.Write(i.fields[key])
+	}
+
+	buffer.WriteByte('}')
+
+	return buffer.Bytes(), nil
+}
+
+func (i *CslItem) set(key string, value interface{}) {
+	marshalledValue, err := json.Marshal(value)
+	if err != nil {
+		logging.Error.Fatal(fmt.Errorf("%w: %v", ErrMarshalCslJson, err))
+	}
+
+	if _, exists := i.fields[key]; !exists {
+		i.keys = append(i.keys, key)
+	}
+
+	i.fields[key] = marshalledValue
+}
+
+// stringField returns the value of a field which may be either a string or a
+// number.
+func (i *CslItem) stringField(key string) string {
+	rawValue, ok := i.fields[key]
+	if !ok {
+		return ""
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(rawValue, &value); err != nil {
+		return ""
+	}
+
+	switch typedValue := value.(type) {
+	case string:
+		return strings.TrimSpace(typedValue)
+	case float64:
+		return strconv.FormatFloat(typedValue, 'f', -1, 64)
+	default:
+		return ""
+	}
+}
+
+func (i *CslItem) names(key string) []cslName {
+	var names []cslName
+
+	if rawValue, ok := i.fields[key]; ok {
+		if err := json.Unmarshal(rawValue, &names); err != nil {
+			return nil
+		}
+	}
+
+	return names
+}
+
+func (i *CslItem) date(key string) string {
+	var date cslDate
+
+	if rawValue, ok := i.fields[key]; ok {
+		if err := json.Unmarshal(rawValue, &date); err != nil {
+			return ""
+		}
+	}
+
+	return date.String()
+}
+
+func joinNames(names []cslName) string {
+	nameStrings := make([]string, len(names))
+	for index, name := range names {
+		nameStrings[index] = name.String()
+	}
+
+	return strings.Join(nameStrings, bibtexAuthorSeparator)
+}
+
+func (i *CslItem) toBibEntry(citeNames *citeNameGenerator) *bibtex.BibEntry {
+	entryType, ok := cslEntryTypes[i.stringField(cslTypeField)]
+	if !ok {
+		entryType = "misc"
+	}
+
+	authors := i.names("author")
+	issued := i.date("issued")
+
+	i.citeName = i.stringField(cslIdField)
+	if i.citeName == "" {
+		var firstAuthor string
+		if len(authors) > 0 {
+			firstAuthor = authors[0].String()
+		}
+
+		i.citeName = citeNames.generate(firstAuthor, i.stringField("title"), issued)
+	}
+
+	entry := bibtex.NewBibEntry(entryType, i.citeName)
+
+	addField := func(name, value string) {
+		if value != "" {
+			entry.AddField(name, bibtex.NewBibConst(value))
+		}
+	}
+
+	for _, field := range cslBibtexFields {
+		addField(field.bibtex, i.stringField(field.csl))
+	}
+
+	addField("author", joinNames(authors))
+	addField("editor", joinNames(i.names("editor")))
+	addField("year", yearRegex.FindString(issued))
+	addField("urldate", i.date("accessed"))
+	addField("pages", strings.ReplaceAll(i.stringField("page"), "-", "--"))
+
+	switch entryType {
+	case "incollection", "inproceedings":
+		addField("booktitle", i.stringField("container-title"))
+	case "article":
+		addField("journal", i.stringField("container-title"))
+	}
+
+	return entry
+}
+
+func bibEntryToCslItem(entry bibtex.BibEntry) *CslItem {
+	item := newCslItem()
+	item.citeName = entry.CiteName
+
+	cslType, ok := bibtexCslTypes[entry.Type]
+	if !ok {
+		cslType = "document"
+	}
+
+	item.set(cslIdField, entry.CiteName)
+	item.set(cslTypeField, cslType)
+
+	field := func(name string) string {
+		if value, ok := entry.Fields[name]; ok {
+			return value.String()
+		}
+
+		return ""
+	}
+
+	for _, fieldNames := range cslBibtexFields {
+		if value := field(fieldNames.bibtex); value != "" {
+			item.set(fieldNames.csl, value)
+		}
+	}
+
+	for _, nameField := range []string{"author", "editor"} {
+		value := field(nameField)
+		if value == "" {
+			continue
+		}
+
+		var names []cslName
+		for _, name := range strings.Split(value, bibtexAuthorSeparator) {
+			names = append(names, parseBibtexName(name))
+		}
+
+		item.set(nameField, names)
+	}
+
+	if containerTitle := field("journal"); containerTitle != "" {
+		item.set("container-title", containerTitle)
+	} else if containerTitle := field("booktitle"); containerTitle != "" {
+		item.set("container-title", containerTitle)
+	}
+
+	if pages := field("pages"); pages != "" {
+		item.set("page", strings.ReplaceAll(pages, "--", "-"))
+	}
+
+	if date := field("date"); date != "" {
+		item.set("issued", parseBibtexDate(date))
+	} else if year := field("year"); year != "" {
+		item.set("issued", parseBibtexDate(year))
+	}
+
+	if urlDate := field("urldate"); urlDate != "" {
+		item.set("accessed", parseBibtexDate(urlDate))
+	}
+
+	return item
+}
+
+// CslBibliography is the contents of a CSL-JSON file.
+type CslBibliography struct {
+	Items []*CslItem
+}
+
+// ParseCslJson parses a CSL-JSON file into bibtex entries, using the `id` of
+// each item as its cite name.
+func ParseCslJson(content []byte) (bibtex.BibTex, CslBibliography, error) {
+	var items []*CslItem
+
+	if err := json.Unmarshal(content, &items); err != nil {
+		return bibtex.BibTex{}, CslBibliography{}, fmt.Errorf("%w: %v", ErrParseCslJson, err)
+	}
+
+	bib := bibtex.NewBibTex()
+	citeNames := newCiteNameGenerator()
+
+	for _, item := range items {
+		bib.AddEntry(item.toBibEntry(citeNames))
+	}
+
+	return *bib, CslBibliography{Items: items}, nil
+}
+
+// BibtexToCsl converts bibtex entries into CSL-JSON items, so that a CSL-JSON
+// file can be written even if the input was in a different format.
+func BibtexToCsl(bib bibtex.BibTex) CslBibliography {
+	items := make([]*CslItem, len(bib.Entries))
+
+	for index, entry := range bib.Entries {
+		items[index] = bibEntryToCslItem(*entry)
+	}
+
+	return CslBibliography{Items: items}
+}
+
+// These are the CSL variables which can be filled in from Crossref.
+var cslEnrichedFields = []string{"title", "DOI", "container-title", "issued"}
+
+// EnrichCsl copies the fields which were filled in from Crossref into the
+// items from the input file, without changing any fields they already have.
+func EnrichCsl(csl CslBibliography, bib bibtex.BibTex) {
+	entries := make(map[string]*bibtex.BibEntry, len(bib.Entries))
+	for _, entry := range bib.Entries {
+		entries[entry.CiteName] = entry
+	}
+
+	for _, item := range csl.Items {
+		entry, ok := entries[item.citeName]
+		if !ok {
+			continue
+		}
+
+		enrichedItem := bibEntryToCslItem(*entry)
+
+		for _, key := range cslEnrichedFields {
+			if _, exists := item.fields[key]; exists {
+				continue
+			}
+
+			if rawValue, ok := enrichedItem.fields[key]; ok {
+				item.keys = append(item.keys, key)
+				item.fields[key] = rawValue
+			}
+		}
+	}
+}
+
+type cslIpfsOutput struct {
+	FileCid       string `json:"fileCid"`
+	FileName      string `json:"fileName"`
+	DirectoryCid  string `json:"directoryCid"`
+	DirectoryName string `json:"directoryName"`
+}
+
+// UpdateCsl sets the `URL` of each archived item to its IPFS or gateway URL and
+// records its CIDs in the `ipfs` key of its `custom` field.
+func UpdateCsl(csl CslBibliography, gateway *string, location Location) error {
+	for _, item := range csl.Items {
+		entryLocation, ok := location.Entries[item.citeName]
+		if !ok {
+			continue
+		}
+
+		var (
+			updatedUrl url.URL
+			err        error
+		)
+
+		if gateway == nil {
+			updatedUrl = entryLocation.IpfsUrl()
+		} else {
+			updatedUrl, err = entryLocation.GatewayUrl(*gateway)
+			if err != nil {
+				return err
+			}
+		}
+
+		item.set(cslUrlField, updatedUrl.String())
+
+		// The custom field is an object too, so we parse it the same way as
+		// an item to keep the order of its keys.
+		custom := newCslItem()
+
+		if rawCustom, ok := item.fields[cslCustomField]; ok {
+			if err := json.Unmarshal(rawCustom, custom); err != nil {
+				return fmt.Errorf("%w: %s: custom field must be an object", ErrParseCslJson, item.citeName)
+			}
+		}
+
+		custom.set(cslIpfsField, cslIpfsOutput{
+			FileCid:       entryLocation.FileCid.String(),
+			FileName:      entryLocation.FileName,
+			DirectoryCid:  entryLocation.DirectoryCid.String(),
+			DirectoryName: entryLocation.DirectoryName,
+		})
+
+		item.set(cslCustomField, custom)
+	}
+
+	return nil
+}
+
+func WriteCsl(csl CslBibliography, file string) error {
+	marshalledCsl, err := json.MarshalIndent(csl.Items, "", outputIndent)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(file, append(marshalledCsl, '\n'), defaultCslPermissions)
+}
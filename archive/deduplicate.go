@@ -58,6 +58,8 @@ func DeduplicateContents(results chan DownloadResult) chan DownloadResult {
 			if !currentBestExists || bibContents.ToMetadata().isBetterThan(currentBest) {
 				bestByCiteName[bibContents.Entry.CiteName] = bibContents.ToMetadata()
 				deduplicated <- downloadResult
+			} else {
+				bibContents.removeContent()
 			}
 		}
 
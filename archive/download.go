@@ -3,15 +3,17 @@ package archive
 import (
 	"context"
 	"errors"
-	"fmt"
+	"github.com/frawleyskid/ipfs-bib/cache"
 	"github.com/frawleyskid/ipfs-bib/config"
 	"github.com/frawleyskid/ipfs-bib/handler"
 	"github.com/frawleyskid/ipfs-bib/logging"
 	"github.com/frawleyskid/ipfs-bib/network"
 	"github.com/frawleyskid/ipfs-bib/resolver"
+	"github.com/frawleyskid/ipfs-bib/spool"
 	"github.com/nickng/bibtex"
-	"io"
 	"net/http"
+	"net/url"
+	"time"
 )
 
 var ErrNoSource = errors.New("source not found")
@@ -20,11 +22,20 @@ type ContentMetadata struct {
 	MediaType string
 	FileName  string
 	Origin    resolver.ContentOrigin
+
+	// If the content was archived from a capture of a web page, like in the
+	// Wayback Machine, this is when it was captured.
+	CaptureTime *time.Time
+
+	// The license of the content and which version of the work it is, if
+	// known.
+	License *string
+	Version *string
 }
 
 type DownloadedContent struct {
 	ContentMetadata
-	Content []byte
+	Content *spool.File
 }
 
 func (c DownloadedContent) ToMetadata() ContentMetadata {
@@ -32,110 +43,252 @@ func (c DownloadedContent) ToMetadata() ContentMetadata {
 }
 
 type DownloadClient struct {
-	httpClient *network.HttpClient
+	httpClient    *network.HttpClient
+	downloadCache *cache.Cache
+	licensePolicy *LicensePolicy
+	sourceSpool   *spool.Spool
+}
+
+func NewHttpClient(cfg config.Config) *network.HttpClient {
+	return network.NewClient(network.ClientOptions{
+		UserAgent:   cfg.File.Archive.UserAgent,
+		RateLimiter: cfg.File.RateLimit.NewRateLimiter(),
+		RetryPolicy: cfg.File.Retry.Policy(),
+	})
 }
 
-func NewDownloadClient(httpClient *network.HttpClient) *DownloadClient {
-	return &DownloadClient{httpClient}
+func NewDownloadClient(httpClient *network.HttpClient, downloadCache *cache.Cache, licensePolicy *LicensePolicy, sourceSpool *spool.Spool) *DownloadClient {
+	return &DownloadClient{httpClient, downloadCache, licensePolicy, sourceSpool}
 }
 
-func (c DownloadClient) responseFromLocator(ctx context.Context, locator resolver.ResolvedLocator) (handler.DownloadResponse, error) {
+func (c DownloadClient) responseFromLocator(ctx context.Context, locator resolver.ResolvedLocator, doi *string) (handler.DownloadResponse, error) {
+	cacheKey := cache.Key{Url: locator.ResolvedUrl, Doi: doi}
+
+	if cacheEntry, ok := c.downloadCache.Get(cacheKey); ok {
+		return handler.DownloadResponse{
+			Url:           cacheEntry.Url,
+			Header:        cacheEntry.Header,
+			Body:          cacheEntry.Body,
+			MediaTypeHint: &cacheEntry.MediaType,
+		}, nil
+	}
+
 	resolvedResponse, err := c.httpClient.Request(ctx, http.MethodGet, locator.ResolvedUrl)
 	if err != nil {
 		return handler.DownloadResponse{}, err
 	}
 
-	preferredResponse := resolvedResponse
-	preferredUrl := locator.ResolvedUrl
-	mediaTypeHint := locator.MediaTypeHint
+	resolvedIsWebPage := network.IsWebPage(resolvedResponse)
+
+	// We read the whole response before making another request, because an
+	// open response holds a connection to the host, and the rate limiter may
+	// not allow another one until it's closed.
+	resolvedBody, err := handler.SpoolResponse(c.sourceSpool, resolvedResponse, locator.MediaTypeHint)
+	if err != nil {
+		return handler.DownloadResponse{}, err
+	}
+
+	downloadResponse := handler.DownloadResponse{
+		Url:           locator.ResolvedUrl,
+		Header:        resolvedResponse.Header,
+		Body:          resolvedBody,
+		MediaTypeHint: locator.MediaTypeHint,
+	}
 
 	// We should prefer PDFs or other files over web pages. We should also
 	// prefer the resolved URL to the original URL. If the resolved URL is a
 	// web page and the original URL is not, then we should use the original
 	// URL. Otherwise, we should use the resolved URL.
-	if network.IsWebPage(resolvedResponse) {
+	if resolvedIsWebPage && locator.OriginalUrl.String() != locator.ResolvedUrl.String() {
 		originalResponse, err := c.httpClient.Request(ctx, http.MethodGet, locator.OriginalUrl)
-		if err != nil {
-			return handler.DownloadResponse{}, err
-		}
 
-		if !network.IsWebPage(originalResponse) {
-			preferredResponse = originalResponse
-			preferredUrl = locator.OriginalUrl
-			mediaTypeHint = nil
-		}
-	}
+		switch {
+		case err != nil:
+			// The original URL may be dead, like when the resolved URL is an
+			// archived copy of it.
+			logging.Verbose.Println(err)
+		case network.IsWebPage(originalResponse):
+			// We don't use the original response, but it still holds a
+			// connection to the host until it's closed.
+			if err := originalResponse.Body.Close(); err != nil {
+				logging.Verbose.Println(err)
+			}
+		default:
+			originalBody, err := handler.SpoolResponse(c.sourceSpool, originalResponse, nil)
+			if err != nil {
+				logging.Verbose.Println(err)
+				break
+			}
 
-	responseBody, err := io.ReadAll(preferredResponse.Body)
-	if err != nil {
-		return handler.DownloadResponse{}, err
-	}
+			resolvedBody.Remove()
 
-	if err := preferredResponse.Body.Close(); err != nil {
-		return handler.DownloadResponse{}, err
+			downloadResponse = handler.DownloadResponse{
+				Url:    locator.OriginalUrl,
+				Header: originalResponse.Header,
+				Body:   originalBody,
+			}
+		}
 	}
 
-	return handler.DownloadResponse{
-		Url:           preferredUrl,
-		Header:        preferredResponse.Header,
-		Body:          responseBody,
-		MediaTypeHint: mediaTypeHint,
-	}, nil
+	c.downloadCache.Put(cacheKey, cache.Entry{
+		Url:       downloadResponse.Url,
+		Header:    downloadResponse.Header,
+		MediaType: downloadResponse.MediaType(),
+		Body:      downloadResponse.Body,
+	})
+
+	return downloadResponse, nil
 }
 
-func (c DownloadClient) Download(ctx context.Context, locator config.SourceLocator, downloadHandler handler.DownloadHandler, sourceResolver resolver.SourceResolver) (DownloadedContent, error) {
+// Download tries each source the resolver finds until one is handled. Each
+// source which is tried, and each resolver which fails, is passed to `record`.
+func (c DownloadClient) Download(ctx context.Context, locator config.SourceLocator, downloadHandler handler.DownloadHandler, sourceResolver resolver.SourceResolver, record func(Attempt)) (DownloadedContent, error) {
+	// The duration of each attempt includes the time taken to look up its
+	// source, which happens between attempts.
+	start := time.Now()
+
+	recordAttempt := func(step AttemptStep, attemptUrl *url.URL, err error) {
+		record(newAttempt(step, attemptUrl, start, err))
+		start = time.Now()
+	}
+
+	// If the URL is dead, we still want to give resolvers like the Wayback
+	// Machine a chance to find it.
 	redirectedUrl, err := c.httpClient.ResolveRedirect(ctx, locator.Url)
 	if err != nil {
-		return DownloadedContent{}, err
+		logging.Verbose.Println(err)
+		redirectedUrl = locator.Url
 	}
 
 	redirectedLocator := config.SourceLocator{
-		Doi: locator.Doi,
-		Url: redirectedUrl,
+		Doi:     locator.Doi,
+		Url:     redirectedUrl,
+		ArxivId: locator.ArxivId,
+		Pmid:    locator.Pmid,
+		Pmcid:   locator.Pmcid,
+		UrlDate: locator.UrlDate,
+		License: locator.License,
 	}
 
-	resolvedLocator, err := sourceResolver.Resolve(ctx, redirectedLocator)
-	if errors.Is(err, resolver.ErrNotResolved) {
-		return DownloadedContent{}, ErrNoSource
-	} else if err != nil {
-		return DownloadedContent{}, err
-	}
+	var (
+		downloadedContent DownloadedContent
+		licenseErr        error
+	)
 
-	downloadResponse, err := c.responseFromLocator(ctx, resolvedLocator)
-	if err != nil {
-		return DownloadedContent{}, err
-	}
+	err = resolver.ResolveEach(ctx, sourceResolver, redirectedLocator, func(resolvedLocator resolver.ResolvedLocator) error {
+		attemptStep, attemptUrl := AttemptStep(resolvedLocator.Origin), resolvedLocator.ResolvedUrl
+
+		// The license of the entry applies unless we know the license of this
+		// particular source. We check it before downloading anything.
+		license := resolvedLocator.License
+		if license == nil {
+			license = locator.License
+		}
+
+		if err := c.licensePolicy.Check(license); err != nil {
+			recordAttempt(attemptStep, &attemptUrl, err)
+
+			if licenseErr == nil {
+				licenseErr = err
+			}
+
+			// This is logged by the caller if no other source is found.
+			return resolver.ErrNotResolved
+		}
+
+		downloadResponse, err := c.responseFromLocator(ctx, resolvedLocator, locator.Doi)
+		if err != nil {
+			recordAttempt(attemptStep, &attemptUrl, err)
+			return err
+		}
+
+		sourceContent, err := downloadHandler.Handle(ctx, downloadResponse)
+
+		// The media type of the content may not be known until it's been
+		// handled, so we check its size against the limit for that media type
+		// again.
+		if err == nil {
+			if err = c.sourceSpool.CheckSize(sourceContent.Content.Size(), sourceContent.MediaType); err != nil {
+				sourceContent.Content.Remove()
+			}
+		}
+
+		// Handlers which found content somewhere else, like in an embedded
+		// document, leave the original response behind.
+		if err != nil || sourceContent.Content != downloadResponse.Body {
+			downloadResponse.Body.Remove()
+		}
+
+		if err != nil {
+			recordAttempt(attemptStep, &attemptUrl, err)
+
+			// Errors other than ErrNotHandled were already logged by the
+			// handler.
+			return resolver.ErrNotResolved
+		}
+
+		recordAttempt(attemptStep, &sourceContent.Url, nil)
+
+		downloadedContent = DownloadedContent{
+			ContentMetadata: ContentMetadata{
+				MediaType:   sourceContent.MediaType,
+				FileName:    sourceContent.FileName,
+				Origin:      resolvedLocator.Origin,
+				CaptureTime: resolvedLocator.CaptureTime,
+				License:     license,
+				Version:     resolvedLocator.Version,
+			},
+			Content: sourceContent.Content,
+		}
+
+		return nil
+	}, func(origin resolver.ContentOrigin, err error) {
+		attemptStep := AttemptStep(origin)
+		if origin == "" {
+			attemptStep = AttemptStepResolve
+		}
 
-	sourceContent, err := downloadHandler.Handle(ctx, downloadResponse)
-	if errors.Is(err, handler.ErrNotHandled) {
+		recordAttempt(attemptStep, nil, err)
+	})
+	if errors.Is(err, resolver.ErrNotResolved) && licenseErr != nil {
+		return DownloadedContent{}, licenseErr
+	} else if errors.Is(err, resolver.ErrNotResolved) {
 		return DownloadedContent{}, ErrNoSource
 	} else if err != nil {
 		return DownloadedContent{}, err
 	}
 
-	return DownloadedContent{
-		ContentMetadata: ContentMetadata{
-			MediaType: sourceContent.MediaType,
-			FileName:  sourceContent.FileName,
-			Origin:    resolvedLocator.Origin,
-		},
-		Content: sourceContent.Content,
-	}, nil
+	return downloadedContent, nil
 }
 
-func FromBibtex(ctx context.Context, cfg config.Config, bib bibtex.BibTex, downloadResults chan DownloadResult) {
-	client := NewDownloadClient(network.NewClient(cfg.File.Archive.UserAgent))
+func FromBibtex(ctx context.Context, cfg config.Config, bib bibtex.BibTex, journal *Journal, previousSources *PreviousSources, budget *Budget, sourceSpool *spool.Spool, downloadResults chan DownloadResult) {
+	httpClient := NewHttpClient(cfg)
+
+	downloadCache, err := cache.FromConfig(cfg, sourceSpool)
+	if err != nil {
+		downloadResults <- DownloadResult{Error: err}
+		close(downloadResults)
+		return
+	}
+
+	licensePolicy := NewLicensePolicy(cfg)
+
+	client := NewDownloadClient(httpClient, downloadCache, licensePolicy, sourceSpool)
 
-	downloadHandler := handler.FromConfig(cfg)
+	downloadHandler := handler.FromConfig(cfg, httpClient, sourceSpool)
 
-	sourceResolver, err := resolver.FromConfig(cfg)
+	sourceResolver, err := resolver.FromConfig(cfg, httpClient)
 	if err != nil {
 		downloadResults <- DownloadResult{Error: err}
 		close(downloadResults)
 		return
 	}
 
-	for _, bibEntry := range bib.Entries {
+	NewEnricher(cfg, httpClient).EnrichAll(ctx, cfg.Jobs(), bib.Entries)
+
+	download := func(ctx context.Context, index int) DownloadResult {
+		bibEntry := bib.Entries[index]
+
 		bibContent := BibContents{Entry: *bibEntry}
 
 		var sourceLocator *config.SourceLocator
@@ -143,50 +296,73 @@ func FromBibtex(ctx context.Context, cfg config.Config, bib bibtex.BibTex, downl
 		switch locator, err := config.LocateEntry(*bibEntry); {
 		case errors.Is(err, config.ErrCouldNotLocateEntry):
 			logging.Verbose.Println(err)
+			bibContent.record(Attempt{Step: AttemptStepLocate, Err: err})
 		case err != nil:
-			downloadResults <- DownloadResult{Error: err}
-			close(downloadResults)
-			return
+			return DownloadResult{Error: err}
 		default:
 			sourceLocator = &locator
 			bibContent.Doi = locator.Doi
 		}
 
-		contents, err := ReadLocalBibSource(*bibEntry, false)
+		if contents, attachments, ok := journal.Restore(bibEntry.CiteName, sourceLocator, sourceSpool); ok && licensePolicy.Check(contents.License) == nil {
+			bibContent.Contents = &contents
+			bibContent.Attachments = attachments
+			return DownloadResult{Contents: bibContent}
+		}
+
+		readLocalBibSource := func(includeSnapshots bool) (DownloadedContent, error) {
+			start := time.Now()
+
+			contents, err := ReadLocalBibSource(*bibEntry, includeSnapshots, sourceSpool)
+			if err == nil {
+				err = licensePolicy.Check(contents.License)
+			}
+
+			// Most entries don't reference a local file, which isn't worth
+			// reporting.
+			if config.BibEntryField(*bibEntry, "file") != nil {
+				bibContent.record(newAttempt(AttemptStep(ContentOriginLocal), nil, start, err))
+			}
+
+			return contents, err
+		}
+
+		contents, err := readLocalBibSource(false)
 		if err == nil {
 			bibContent.Contents = &contents
-			downloadResults <- DownloadResult{Contents: bibContent}
-			continue
-		} else if !errors.Is(err, ErrNoSource) {
-			logging.Verbose.Println(err)
+			return DownloadResult{Contents: bibContent}
 		}
 
+		bibContent.skipSource(err)
+
 		if sourceLocator != nil {
-			contents, err = client.Download(ctx, *sourceLocator, downloadHandler, sourceResolver)
+			contents, err = client.Download(ctx, *sourceLocator, downloadHandler, sourceResolver, bibContent.record)
 			if err == nil {
 				bibContent.Contents = &contents
-				downloadResults <- DownloadResult{Contents: bibContent}
-				continue
-			} else if !errors.Is(err, ErrNoSource) {
-				logging.Verbose.Println(err)
+				return DownloadResult{Contents: bibContent}
 			}
+
+			bibContent.skipSource(err)
 		}
 
 		if cfg.File.Snapshot.LocalFile {
-			contents, err = ReadLocalBibSource(*bibEntry, true)
+			contents, err = readLocalBibSource(true)
 			if err == nil {
 				bibContent.Contents = &contents
-				downloadResults <- DownloadResult{Contents: bibContent}
-				continue
-			} else if !errors.Is(err, ErrNoSource) {
-				logging.Verbose.Println(err)
+				return DownloadResult{Contents: bibContent}
 			}
+
+			bibContent.skipSource(err)
 		}
 
-		downloadResults <- DownloadResult{Contents: bibContent}
+		bibContent.logNotArchived()
+
+		return DownloadResult{Contents: bibContent}
+	}
 
-		logging.Error.Println(fmt.Sprintf("Could not find a source for citation: %s", bibEntry.CiteName))
+	entryAt := func(index int) bibtex.BibEntry {
+		return *bib.Entries[index]
 	}
 
-	close(downloadResults)
+	downloadConcurrently(ctx, cfg.Jobs(), len(bib.Entries), previousSources.wrap(entryAt, budget.wrap(entryAt, download)), downloadResults)
 }
@@ -0,0 +1,188 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/frawleyskid/ipfs-bib/config"
+	"github.com/frawleyskid/ipfs-bib/logging"
+	"github.com/frawleyskid/ipfs-bib/network"
+	"github.com/frawleyskid/ipfs-bib/resolver"
+	"github.com/nickng/bibtex"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// This is the number of search results to compare against an entry when
+// searching for its DOI.
+const crossrefSearchRows = 5
+
+var htmlTagRegex = regexp.MustCompile(`<[^>]+>`)
+
+// This maps bibtex entry types to the field which holds the title of the
+// journal, book or proceedings they were published in.
+var containerTitleFields = map[string]string{
+	"article":       "journal",
+	"incollection":  "booktitle",
+	"inproceedings": "booktitle",
+}
+
+// normalizeTitle strips everything but letters and numbers from a title, so
+// that titles which only differ in case, punctuation or markup are equal.
+func normalizeTitle(title string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			return unicode.ToLower(r)
+		}
+
+		return -1
+	}, htmlTagRegex.ReplaceAllString(title, ""))
+}
+
+// Enricher fills in missing metadata for bibtex entries using Crossref.
+type Enricher struct {
+	client *resolver.CrossrefClient
+}
+
+func NewEnricher(cfg config.Config, httpClient *network.HttpClient) *Enricher {
+	if !cfg.File.Crossref.Enrich {
+		return nil
+	}
+
+	return &Enricher{client: resolver.NewCrossrefClient(httpClient, cfg)}
+}
+
+// searchDoi searches for a work with the same title as the entry, and the
+// same year if the entry has one.
+func (e *Enricher) searchDoi(ctx context.Context, entry bibtex.BibEntry, title string) (*resolver.CrossrefWork, error) {
+	reference := []string{title}
+
+	if author := config.BibEntryField(entry, "author"); author != nil {
+		reference = append(reference, strings.Split(*author, bibtexAuthorSeparator)[0])
+	}
+
+	var year string
+	if rawYear := config.BibEntryField(entry, "year"); rawYear != nil {
+		year = yearRegex.FindString(*rawYear)
+		reference = append(reference, year)
+	}
+
+	works, err := e.client.Search(ctx, strings.Join(reference, " "), crossrefSearchRows)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, work := range works {
+		if normalizeTitle(work.FirstTitle()) != normalizeTitle(title) {
+			continue
+		}
+
+		if year != "" && work.Issued.Year() != 0 && strconv.Itoa(work.Issued.Year()) != year {
+			continue
+		}
+
+		return &works[i], nil
+	}
+
+	return nil, nil //nolint:nilnil
+}
+
+// Enrich fills in the title, year and journal of an entry if they're missing.
+// If the entry only has a title, this searches for its DOI. Fields which the
+// entry already has are never changed.
+func (e *Enricher) Enrich(ctx context.Context, entry *bibtex.BibEntry) error {
+	if e == nil {
+		return nil
+	}
+
+	var work *resolver.CrossrefWork
+
+	switch locator, err := config.LocateEntry(*entry); {
+	case errors.Is(err, config.ErrCouldNotLocateEntry):
+		title := config.BibEntryField(*entry, "title")
+		if title == nil {
+			return nil
+		}
+
+		work, err = e.searchDoi(ctx, *entry, *title)
+		if err != nil {
+			return err
+		}
+
+		if work == nil {
+			logging.Verbose.Println(fmt.Sprintf("Could not find a DOI on Crossref for citation: %s", entry.CiteName))
+			return nil
+		}
+
+		entry.AddField("doi", bibtex.NewBibConst(work.Doi))
+	case err != nil:
+		return err
+	case locator.Doi == nil:
+		return nil
+	default:
+		doiWork, err := e.client.Work(ctx, *locator.Doi)
+		if errors.Is(err, resolver.ErrNotResolved) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		work = &doiWork
+	}
+
+	addMissingField := func(name, value string) {
+		if _, exists := entry.Fields[name]; !exists && value != "" {
+			entry.AddField(name, bibtex.NewBibConst(value))
+		}
+	}
+
+	addMissingField("title", htmlTagRegex.ReplaceAllString(work.FirstTitle(), ""))
+
+	if _, hasDate := entry.Fields["date"]; !hasDate && work.Issued.Year() != 0 {
+		addMissingField("year", strconv.Itoa(work.Issued.Year()))
+	}
+
+	if containerField, ok := containerTitleFields[entry.Type]; ok {
+		addMissingField(containerField, htmlTagRegex.ReplaceAllString(work.FirstContainerTitle(), ""))
+	}
+
+	return nil
+}
+
+// EnrichAll enriches each entry using a pool of `jobs` workers, and returns
+// once every entry has been enriched. This must finish before any sources are
+// downloaded, because entries are read while other entries are downloaded,
+// like when they're given directories.
+func (e *Enricher) EnrichAll(ctx context.Context, jobs int, entries []*bibtex.BibEntry) {
+	if e == nil {
+		return
+	}
+
+	indices := make(chan int)
+
+	var workers sync.WaitGroup
+
+	for i := 0; i < jobs; i++ {
+		workers.Add(1)
+
+		go func() {
+			defer workers.Done()
+
+			for index := range indices {
+				if err := e.Enrich(ctx, entries[index]); err != nil {
+					logging.Verbose.Println(err)
+				}
+			}
+		}()
+	}
+
+	for index := range entries {
+		indices <- index
+	}
+
+	close(indices)
+	workers.Wait()
+}
@@ -0,0 +1,136 @@
+package archive
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/frawleyskid/ipfs-bib/config"
+	"github.com/nickng/bibtex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type Format string
+
+const (
+	FormatBibtex  Format = "bibtex"
+	FormatRis     Format = "ris"
+	FormatCslJson Format = "csl-json"
+)
+
+var (
+	ErrUnknownFormat     = errors.New("unknown format")
+	ErrUnsupportedOutput = errors.New("can not write output in this format")
+)
+
+var formatsByExtension = map[string]Format{
+	".bib":    FormatBibtex,
+	".bibtex": FormatBibtex,
+	".ris":    FormatRis,
+	".json":   FormatCslJson,
+}
+
+func readInput(inputPath string) ([]byte, error) {
+	var (
+		inputFile io.ReadCloser
+		err       error
+	)
+
+	if inputPath == stdinFileName {
+		inputFile = os.Stdin
+	} else {
+		inputFile, err = os.Open(inputPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	content, err := io.ReadAll(inputFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := inputFile.Close(); err != nil {
+		return nil, err
+	}
+
+	return content, nil
+}
+
+// DetectFormat guesses the format of an input file from its extension, or
+// failing that, from its contents.
+func DetectFormat(inputPath string, content []byte) Format {
+	if format, ok := formatsByExtension[strings.ToLower(filepath.Ext(inputPath))]; ok {
+		return format
+	}
+
+	trimmedContent := bytes.TrimLeft(bytes.TrimPrefix(content, []byte(byteOrderMark)), " \t\r\n")
+
+	if bytes.HasPrefix(trimmedContent, []byte("[")) {
+		return FormatCslJson
+	}
+
+	if risLineRegex.Match(bytes.SplitN(trimmedContent, []byte("\n"), 2)[0]) {
+		return FormatRis
+	}
+
+	return FormatBibtex
+}
+
+// ParseInput parses the citations in the input file, using the format passed
+// with --format or otherwise detecting it. If the input is a CSL-JSON file,
+// this also returns the original CSL-JSON items.
+func ParseInput(cfg config.Config, inputPath string) (bibtex.BibTex, *CslBibliography, error) {
+	content, err := readInput(inputPath)
+	if err != nil {
+		return bibtex.BibTex{}, nil, err
+	}
+
+	format := DetectFormat(inputPath, content)
+	if flagFormat := cfg.Flags.MaybeFormat(); flagFormat != nil {
+		format = Format(*flagFormat)
+	}
+
+	switch format {
+	case FormatBibtex:
+		bib, err := ParseBibtex(content)
+		return bib, nil, err
+	case FormatRis:
+		bib, err := ParseRis(content)
+		return bib, nil, err
+	case FormatCslJson:
+		bib, csl, err := ParseCslJson(content)
+		if err != nil {
+			return bibtex.BibTex{}, nil, err
+		}
+
+		return bib, &csl, nil
+	default:
+		return bibtex.BibTex{}, nil, fmt.Errorf("%w: %s", ErrUnknownFormat, format)
+	}
+}
+
+// OutputFormat returns the format passed with --output-format, or otherwise
+// detects it from the extension of the output path.
+func OutputFormat(cfg config.Config) (Format, error) {
+	format := FormatBibtex
+
+	if flagFormat := cfg.Flags.MaybeOutputFormat(); flagFormat != nil {
+		format = Format(*flagFormat)
+	} else if outputPath := cfg.Flags.MaybeOutputPath(); outputPath != nil {
+		if detectedFormat, ok := formatsByExtension[strings.ToLower(filepath.Ext(*outputPath))]; ok {
+			format = detectedFormat
+		}
+	}
+
+	switch format {
+	case FormatBibtex, FormatCslJson:
+		return format, nil
+	case FormatRis:
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedOutput, format)
+	default:
+		return "", fmt.Errorf("%w: %s", ErrUnknownFormat, format)
+	}
+}
@@ -0,0 +1,415 @@
+package archive
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/frawleyskid/ipfs-bib/config"
+	"github.com/frawleyskid/ipfs-bib/logging"
+	"github.com/frawleyskid/ipfs-bib/resolver"
+	"github.com/frawleyskid/ipfs-bib/spool"
+	"github.com/ipfs/go-cid"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	journalFileName         = "journal.jsonl"
+	journalSourcesDirName   = "sources"
+	defaultStatePermissions = 0755
+	journalFilePermissions  = 0644
+)
+
+var ErrInvalidJournal = errors.New("could not parse state journal")
+
+type JournalStatus string
+
+const (
+	JournalStatusArchived    JournalStatus = "archived"
+	JournalStatusNotArchived JournalStatus = "notArchived"
+)
+
+// JournalAttachment is an attachment which was archived alongside the main
+// source of an entry.
+type JournalAttachment struct {
+	ContentHash string `json:"contentHash"`
+	MediaType   string `json:"mediaType"`
+	FileName    string `json:"fileName,omitempty"`
+	FileCid     string `json:"fileCid"`
+}
+
+type JournalRecord struct {
+	CiteName      string              `json:"citeName"`
+	Status        JournalStatus       `json:"status"`
+	Url           *string             `json:"url"`
+	Doi           *string             `json:"doi"`
+	ContentHash   string              `json:"contentHash,omitempty"`
+	MediaType     string              `json:"mediaType,omitempty"`
+	FileName      string              `json:"fileName,omitempty"`
+	ContentOrigin string              `json:"contentOrigin,omitempty"`
+	CaptureTime   *time.Time          `json:"captureTime,omitempty"`
+	License       *string             `json:"license,omitempty"`
+	Version       *string             `json:"version,omitempty"`
+	FileCid       string              `json:"fileCid,omitempty"`
+	DirectoryCid  string              `json:"directoryCid,omitempty"`
+	DirectoryName string              `json:"directoryName,omitempty"`
+	Attachments   []JournalAttachment `json:"attachments,omitempty"`
+	Time          time.Time           `json:"time"`
+}
+
+func (r JournalRecord) matchesLocator(locator *config.SourceLocator) bool {
+	var (
+		locatorUrl *string
+		locatorDoi *string
+	)
+
+	if locator != nil {
+		rawUrl := locator.Url.String()
+		locatorUrl = &rawUrl
+		locatorDoi = locator.Doi
+	}
+
+	return stringPtrEqual(r.Url, locatorUrl) && stringPtrEqual(r.Doi, locatorDoi)
+}
+
+func stringPtrEqual(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return *a == *b
+}
+
+func hashContent(content io.Reader) (string, error) {
+	hash := sha256.New()
+
+	if _, err := io.Copy(hash, content); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Journal is an append-only log of the outcome of each entry, which lets us
+// resume a run without downloading sources which were already archived. The
+// format is documented in `docs/state.md`.
+type Journal struct {
+	dir     string
+	file    *os.File
+	records map[BibCiteName]JournalRecord
+	lock    sync.Mutex
+}
+
+func OpenJournal(stateDir string) (*Journal, error) {
+	if err := os.MkdirAll(filepath.Join(stateDir, journalSourcesDirName), defaultStatePermissions); err != nil {
+		return nil, err
+	}
+
+	journalPath := filepath.Join(stateDir, journalFileName)
+
+	records, err := readJournal(journalPath)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(journalPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, journalFilePermissions)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Journal{
+		dir:     stateDir,
+		file:    file,
+		records: records,
+	}, nil
+}
+
+func readJournal(journalPath string) (map[BibCiteName]JournalRecord, error) {
+	records := make(map[BibCiteName]JournalRecord)
+
+	file, err := os.Open(journalPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return records, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var record JournalRecord
+
+		// If a previous run was killed while writing a record, the last line
+		// may be truncated, so we skip lines we can't parse.
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			logging.Verbose.Println(fmt.Errorf("%w: line %d: %v", ErrInvalidJournal, lineNumber, err))
+			continue
+		}
+
+		// Later records for the same entry take precedence.
+		records[record.CiteName] = record
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidJournal, err)
+	}
+
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+func (j *Journal) sourcePath(contentHash string) string {
+	return filepath.Join(j.dir, journalSourcesDirName, contentHash)
+}
+
+// restoreSource reads a source from the state directory where it is rather
+// than copying it into the spool, and checks that it wasn't corrupted.
+func (j *Journal) restoreSource(contentHash string, mediaType string, sourceSpool *spool.Spool) (*spool.File, error) {
+	content, err := sourceSpool.Borrow(j.sourcePath(contentHash), mediaType)
+	if err != nil {
+		return nil, err
+	}
+
+	contentFile, err := content.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	actualHash, err := hashContent(contentFile)
+
+	if closeErr := contentFile.Close(); closeErr != nil {
+		logging.Verbose.Println(closeErr)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if actualHash != contentHash {
+		return nil, fmt.Errorf("%w: source in state directory is corrupted: %s", ErrInvalidJournal, contentHash)
+	}
+
+	return content, nil
+}
+
+// Restore returns the contents of an entry which was archived by a previous
+// run, as long as it was located the same way it is now, along with any
+// attachments which were archived alongside it.
+func (j *Journal) Restore(citeName BibCiteName, locator *config.SourceLocator, sourceSpool *spool.Spool) (DownloadedContent, []DownloadedContent, bool) {
+	if j == nil {
+		return DownloadedContent{}, nil, false
+	}
+
+	j.lock.Lock()
+	record, ok := j.records[citeName]
+	j.lock.Unlock()
+
+	if !ok || record.Status != JournalStatusArchived || !record.matchesLocator(locator) {
+		return DownloadedContent{}, nil, false
+	}
+
+	content, err := j.restoreSource(record.ContentHash, record.MediaType, sourceSpool)
+	if err != nil {
+		logging.Verbose.Println(err)
+		return DownloadedContent{}, nil, false
+	}
+
+	attachments := make([]DownloadedContent, 0, len(record.Attachments))
+
+	for _, attachment := range record.Attachments {
+		attachmentContent, err := j.restoreSource(attachment.ContentHash, attachment.MediaType, sourceSpool)
+		if err != nil {
+			logging.Verbose.Println(err)
+			return DownloadedContent{}, nil, false
+		}
+
+		attachments = append(attachments, DownloadedContent{
+			Content: attachmentContent,
+			ContentMetadata: ContentMetadata{
+				MediaType: attachment.MediaType,
+				FileName:  attachment.FileName,
+				Origin:    resolver.ContentOrigin(record.ContentOrigin),
+				License:   record.License,
+			},
+		})
+	}
+
+	return DownloadedContent{
+		Content: content,
+		ContentMetadata: ContentMetadata{
+			MediaType:   record.MediaType,
+			FileName:    record.FileName,
+			Origin:      resolver.ContentOrigin(record.ContentOrigin),
+			CaptureTime: record.CaptureTime,
+			License:     record.License,
+			Version:     record.Version,
+		},
+	}, attachments, true
+}
+
+// ArchivedRecord returns the record of an entry which was archived in the
+// directory with the given CID, which is how we know the license and the main
+// file of a source kept from the previous root passed to --update-from.
+func (j *Journal) ArchivedRecord(citeName BibCiteName, directoryCid cid.Cid) (JournalRecord, bool) {
+	if j == nil {
+		return JournalRecord{}, false
+	}
+
+	j.lock.Lock()
+	record, ok := j.records[citeName]
+	j.lock.Unlock()
+
+	if !ok || record.Status != JournalStatusArchived || record.DirectoryCid != directoryCid.String() {
+		return JournalRecord{}, false
+	}
+
+	return record, true
+}
+
+func (j *Journal) saveSource(content *spool.File) (string, error) {
+	contentFile, err := content.Open()
+	if err != nil {
+		return "", err
+	}
+
+	defer func() {
+		if err := contentFile.Close(); err != nil {
+			logging.Verbose.Println(err)
+		}
+	}()
+
+	// We write to a temporary file first so that a partially written source
+	// is never mistaken for a complete one. We don't know where the source
+	// goes until we've hashed it, so we hash it as we write it.
+	tempFile, err := ioutil.TempFile(filepath.Join(j.dir, journalSourcesDirName), ".tmp-*")
+	if err != nil {
+		return "", err
+	}
+
+	contentHash, err := hashContent(io.TeeReader(contentFile, tempFile))
+
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tempFile.Name(), j.sourcePath(contentHash))
+	}
+
+	// The temporary file would otherwise be left in the state directory.
+	if err != nil {
+		if removeErr := os.Remove(tempFile.Name()); removeErr != nil {
+			logging.Verbose.Println(removeErr)
+		}
+
+		return "", err
+	}
+
+	return contentHash, nil
+}
+
+// Record appends the outcome of an entry to the journal. If the entry was
+// archived, `location` is where it was stored.
+func (j *Journal) Record(contents BibContents, location *config.BibEntryLocation) error {
+	if j == nil {
+		return nil
+	}
+
+	var locator *config.SourceLocator
+	if entryLocator, err := config.LocateEntry(contents.Entry); err == nil {
+		locator = &entryLocator
+	}
+
+	record := JournalRecord{
+		CiteName: contents.Entry.CiteName,
+		Status:   JournalStatusNotArchived,
+		Doi:      contents.Doi,
+		Time:     time.Now().UTC(),
+	}
+
+	if locator != nil {
+		rawUrl := locator.Url.String()
+		record.Url = &rawUrl
+		record.Doi = locator.Doi
+	}
+
+	if contents.Contents != nil && location != nil {
+		contentHash, err := j.saveSource(contents.Contents.Content)
+		if err != nil {
+			return err
+		}
+
+		record.Status = JournalStatusArchived
+		record.ContentHash = contentHash
+		record.MediaType = contents.Contents.MediaType
+		record.FileName = contents.Contents.FileName
+		record.ContentOrigin = string(contents.Contents.Origin)
+		record.CaptureTime = contents.Contents.CaptureTime
+		record.License = contents.Contents.License
+		record.Version = contents.Contents.Version
+		record.FileCid = location.FileCid.String()
+		record.DirectoryCid = location.DirectoryCid.String()
+		record.DirectoryName = location.DirectoryName
+
+		// The store lists the files in the order they were added, so the
+		// attachments come after the main source.
+		for index, attachment := range contents.Attachments {
+			attachmentHash, err := j.saveSource(attachment.Content)
+			if err != nil {
+				return err
+			}
+
+			record.Attachments = append(record.Attachments, JournalAttachment{
+				ContentHash: attachmentHash,
+				MediaType:   attachment.MediaType,
+				FileName:    attachment.FileName,
+				FileCid:     location.Files[index+1].FileCid.String(),
+			})
+		}
+	}
+
+	marshalledRecord, err := json.Marshal(record)
+	if err != nil {
+		logging.Error.Fatal(err)
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if _, err := j.file.Write(append(marshalledRecord, '\n')); err != nil {
+		return err
+	}
+
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+
+	j.records[record.CiteName] = record
+
+	return nil
+}
+
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+
+	return j.file.Close()
+}
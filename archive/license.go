@@ -0,0 +1,87 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"github.com/frawleyskid/ipfs-bib/config"
+	"github.com/frawleyskid/ipfs-bib/logging"
+)
+
+var ErrLicenseNotAllowed = errors.New("license is not allowed")
+
+// LicenseError is returned when a source was found, but it wasn't archived
+// because its license isn't allowed by the license policy.
+type LicenseError struct {
+	// This is nil if the license is unknown.
+	License *string
+}
+
+func (e LicenseError) Error() string {
+	if e.License == nil {
+		return fmt.Sprintf("%s: unknown license", ErrLicenseNotAllowed)
+	}
+
+	return fmt.Sprintf("%s: %s", ErrLicenseNotAllowed, *e.License)
+}
+
+func (e LicenseError) Unwrap() error {
+	return ErrLicenseNotAllowed
+}
+
+// LicensePolicy decides which sources may be archived based on their license.
+type LicensePolicy struct {
+	allowed      map[string]struct{}
+	allowUnknown bool
+}
+
+func NewLicensePolicy(cfg config.Config) *LicensePolicy {
+	if len(cfg.File.License.Allow) == 0 {
+		return nil
+	}
+
+	allowed := make(map[string]struct{}, len(cfg.File.License.Allow))
+	for _, license := range cfg.File.License.Allow {
+		allowed[config.NormalizeLicense(license)] = struct{}{}
+	}
+
+	return &LicensePolicy{allowed, cfg.File.License.AllowUnknown}
+}
+
+// Check returns a LicenseError if a source with the given license may not be
+// archived.
+func (p *LicensePolicy) Check(license *string) error {
+	if p == nil {
+		return nil
+	}
+
+	if license == nil {
+		if p.allowUnknown {
+			return nil
+		}
+
+		return &LicenseError{License: nil}
+	}
+
+	if _, ok := p.allowed[*license]; ok {
+		return nil
+	}
+
+	return &LicenseError{License: license}
+}
+
+// skipSource logs why a source for the entry couldn't be used. If it was
+// because of its license, the entry is reported as skipped.
+func (c *BibContents) skipSource(err error) {
+	licenseErr := &LicenseError{}
+
+	switch {
+	case errors.As(err, &licenseErr):
+		logging.Verbose.Println(fmt.Sprintf("Skipping source for citation %s: %v", c.Entry.CiteName, err))
+
+		if c.Skipped == nil {
+			c.Skipped = licenseErr
+		}
+	case !errors.Is(err, ErrNoSource):
+		logging.Verbose.Println(err)
+	}
+}
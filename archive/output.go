@@ -7,26 +7,137 @@ import (
 	"github.com/frawleyskid/ipfs-bib/config"
 	"github.com/frawleyskid/ipfs-bib/logging"
 	"strconv"
+	"text/tabwriter"
+	"time"
 )
 
-const outputIndent = "  "
+const (
+	outputIndent            = "  "
+	failureTablePadding     = 2
+	failureTablePlaceholder = "-"
+)
+
+type RejectedOutput struct {
+	Url    string `json:"url"`
+	Reason string `json:"reason"`
+}
+
+func newRejectedOutput(attempts []Attempt) []RejectedOutput {
+	rejected := rejectedSources(attempts)
+	rejectedOutput := make([]RejectedOutput, 0, len(rejected))
+
+	for _, validationErr := range rejected {
+		rejectedOutput = append(rejectedOutput, RejectedOutput{
+			Url:    validationErr.Url.String(),
+			Reason: validationErr.Reason,
+		})
+	}
+
+	return rejectedOutput
+}
+
+type AttemptOutput struct {
+	Step       string  `json:"step"`
+	Url        *string `json:"url"`
+	HttpStatus *int    `json:"httpStatus"`
+	ErrorClass *string `json:"errorClass"`
+	Error      *string `json:"error"`
+	DurationMs int64   `json:"durationMs"`
+}
+
+func newAttemptOutput(attempts []Attempt) []AttemptOutput {
+	attemptOutput := make([]AttemptOutput, 0, len(attempts))
+
+	for _, attempt := range attempts {
+		output := AttemptOutput{
+			Step:       string(attempt.Step),
+			HttpStatus: attempt.MaybeHttpStatus(),
+			DurationMs: attempt.Duration.Milliseconds(),
+		}
+
+		if attemptUrl := attempt.MaybeUrl(); attemptUrl != nil {
+			formattedUrl := attemptUrl.String()
+			output.Url = &formattedUrl
+		}
+
+		if errorClass := attempt.MaybeErrorClass(); errorClass != nil {
+			formattedErrorClass, formattedError := string(*errorClass), attempt.Err.Error()
+			output.ErrorClass = &formattedErrorClass
+			output.Error = &formattedError
+		}
+
+		attemptOutput = append(attemptOutput, output)
+	}
+
+	return attemptOutput
+}
+
+type FileOutput struct {
+	FileCid    string `json:"fileCid"`
+	FileName   string `json:"fileName"`
+	IpfsUrl    string `json:"ipfsUrl"`
+	GatewayUrl string `json:"gatewayUrl"`
+}
+
+func newFileOutput(location config.BibEntryLocation, gateway string) ([]FileOutput, error) {
+	fileOutput := make([]FileOutput, 0, len(location.Files))
+
+	for _, file := range location.Files {
+		gatewayUrl, err := file.GatewayUrl(gateway)
+		if err != nil {
+			return nil, err
+		}
+
+		ipfsUrl := file.IpfsUrl()
+
+		fileOutput = append(fileOutput, FileOutput{
+			FileCid:    file.FileCid.String(),
+			FileName:   file.FileName,
+			IpfsUrl:    ipfsUrl.String(),
+			GatewayUrl: gatewayUrl.String(),
+		})
+	}
+
+	return fileOutput, nil
+}
 
 type ArchivedOutput struct {
-	CiteName      string  `json:"citeName"`
-	Doi           *string `json:"doi"`
-	MediaType     string  `json:"mediaType"`
-	FileCid       string  `json:"fileCid"`
-	FileName      string  `json:"fileName"`
-	DirectoryCid  string  `json:"directoryCid"`
-	DirectoryName string  `json:"directoryName"`
-	IpfsUrl       string  `json:"ipfsUrl"`
-	GatewayUrl    string  `json:"gatewayUrl"`
-	ContentOrigin string  `json:"contentOrigin"`
+	CiteName      string           `json:"citeName"`
+	Doi           *string          `json:"doi"`
+	MediaType     string           `json:"mediaType"`
+	FileCid       string           `json:"fileCid"`
+	FileName      string           `json:"fileName"`
+	DirectoryCid  string           `json:"directoryCid"`
+	DirectoryName string           `json:"directoryName"`
+	Files         []FileOutput     `json:"files"`
+	IpfsUrl       string           `json:"ipfsUrl"`
+	GatewayUrl    string           `json:"gatewayUrl"`
+	ContentOrigin string           `json:"contentOrigin"`
+	CaptureTime   *string          `json:"captureTime"`
+	License       *string          `json:"license"`
+	Version       *string          `json:"version"`
+	Status        string           `json:"status"`
+	Rejected      []RejectedOutput `json:"rejected"`
+	Attempts      []AttemptOutput  `json:"attempts"`
 }
 
+type NotArchivedReason string
+
+const (
+	NotArchivedReasonNotFound          NotArchivedReason = "notFound"
+	NotArchivedReasonLicenseNotAllowed NotArchivedReason = "licenseNotAllowed"
+	NotArchivedReasonInvalidContent    NotArchivedReason = "invalidContent"
+	NotArchivedReasonTooLarge          NotArchivedReason = "tooLarge"
+	NotArchivedReasonOverBudget        NotArchivedReason = "overBudget"
+)
+
 type NotArchivedOutput struct {
-	CiteName string  `json:"citeName"`
-	Doi      *string `json:"doi"`
+	CiteName string            `json:"citeName"`
+	Doi      *string           `json:"doi"`
+	Reason   NotArchivedReason `json:"reason"`
+	License  *string           `json:"license"`
+	Rejected []RejectedOutput  `json:"rejected"`
+	Attempts []AttemptOutput   `json:"attempts"`
 }
 
 type Output struct {
@@ -35,6 +146,7 @@ type Output struct {
 	TotalArchived int                 `json:"totalArchived"`
 	Archived      []ArchivedOutput    `json:"archived"`
 	NotArchived   []NotArchivedOutput `json:"notArchived"`
+	Removed       []string            `json:"removed"`
 }
 
 func NewOutput(cfg config.Config, metadata []BibMetadata, location Location) (Output, error) {
@@ -52,6 +164,17 @@ func NewOutput(cfg config.Config, metadata []BibMetadata, location Location) (Ou
 
 			ipfsUrl := bibLocation.IpfsUrl()
 
+			files, err := newFileOutput(bibLocation, cfg.File.Ipfs.Gateway)
+			if err != nil {
+				return Output{}, err
+			}
+
+			var captureTime *string
+			if bibMetadata.Contents.CaptureTime != nil {
+				formattedCaptureTime := bibMetadata.Contents.CaptureTime.UTC().Format(time.RFC3339)
+				captureTime = &formattedCaptureTime
+			}
+
 			archivedEntries = append(archivedEntries, ArchivedOutput{
 				CiteName:      bibMetadata.Entry.CiteName,
 				Doi:           bibMetadata.Doi,
@@ -60,24 +183,54 @@ func NewOutput(cfg config.Config, metadata []BibMetadata, location Location) (Ou
 				FileName:      bibLocation.FileName,
 				DirectoryCid:  bibLocation.DirectoryCid.String(),
 				DirectoryName: bibLocation.DirectoryName,
+				Files:         files,
 				IpfsUrl:       ipfsUrl.String(),
 				GatewayUrl:    gatewayUrl.String(),
 				ContentOrigin: string(bibMetadata.Contents.Origin),
+				CaptureTime:   captureTime,
+				License:       bibMetadata.Contents.License,
+				Version:       bibMetadata.Contents.Version,
+				Status:        string(location.Status[bibMetadata.Entry.CiteName]),
+				Rejected:      newRejectedOutput(bibMetadata.Attempts),
+				Attempts:      newAttemptOutput(bibMetadata.Attempts),
 			})
 		} else {
-			notArchivedEntries = append(notArchivedEntries, NotArchivedOutput{
+			notArchivedOutput := NotArchivedOutput{
 				CiteName: bibMetadata.Entry.CiteName,
 				Doi:      bibMetadata.Doi,
-			})
+				Reason:   NotArchivedReasonNotFound,
+				Rejected: newRejectedOutput(bibMetadata.Attempts),
+				Attempts: newAttemptOutput(bibMetadata.Attempts),
+			}
+
+			switch {
+			case bibMetadata.OverBudget:
+				notArchivedOutput.Reason = NotArchivedReasonOverBudget
+			case bibMetadata.Skipped != nil:
+				notArchivedOutput.Reason = NotArchivedReasonLicenseNotAllowed
+				notArchivedOutput.License = bibMetadata.Skipped.License
+			case len(notArchivedOutput.Rejected) > 0:
+				notArchivedOutput.Reason = NotArchivedReasonInvalidContent
+			case hasTooLargeAttempt(bibMetadata.Attempts):
+				notArchivedOutput.Reason = NotArchivedReasonTooLarge
+			}
+
+			notArchivedEntries = append(notArchivedEntries, notArchivedOutput)
 		}
 	}
 
+	removed := location.Removed
+	if removed == nil {
+		removed = []string{}
+	}
+
 	return Output{
 		Cid:           location.Root.String(),
 		TotalEntries:  len(metadata),
 		TotalArchived: len(archivedEntries),
 		Archived:      archivedEntries,
 		NotArchived:   notArchivedEntries,
+		Removed:       removed,
 	}, nil
 }
 
@@ -96,6 +249,100 @@ func (o Output) PrettyPrint() {
 	prettyPrintLine("Total entries", strconv.Itoa(o.TotalEntries))
 	prettyPrintLine("Entries archived", good(o.TotalArchived))
 	prettyPrintLine("Entries not archived", bad(o.TotalEntries-o.TotalArchived))
+
+	totalSkipped, totalOverBudget := 0, 0
+	for _, notArchived := range o.NotArchived {
+		switch notArchived.Reason {
+		case NotArchivedReasonLicenseNotAllowed:
+			totalSkipped++
+		case NotArchivedReasonOverBudget:
+			totalOverBudget++
+		}
+	}
+
+	if totalSkipped > 0 {
+		prettyPrintLine("Entries skipped by license", strconv.Itoa(totalSkipped))
+	}
+
+	if totalOverBudget > 0 {
+		prettyPrintLine("Entries skipped over budget", strconv.Itoa(totalOverBudget))
+	}
+
+	totalRejected := 0
+	for _, archived := range o.Archived {
+		totalRejected += len(archived.Rejected)
+	}
+
+	for _, notArchived := range o.NotArchived {
+		totalRejected += len(notArchived.Rejected)
+	}
+
+	if totalRejected > 0 {
+		prettyPrintLine("Sources rejected as invalid", strconv.Itoa(totalRejected))
+	}
+
+	if len(o.Removed) > 0 {
+		prettyPrintLine("Sources removed", strconv.Itoa(len(o.Removed)))
+	}
+
+	if len(o.NotArchived) > 0 {
+		o.prettyPrintFailures()
+	}
+}
+
+func orPlaceholder(value *string) string {
+	if value == nil {
+		return failureTablePlaceholder
+	}
+
+	return *value
+}
+
+// prettyPrintFailures prints a table of each step taken for the entries which
+// weren't archived.
+func (o Output) prettyPrintFailures() {
+	titleFunc := color.New(color.Bold).SprintFunc()
+
+	if _, err := fmt.Fprintf(color.Output, "\n%s:\n", titleFunc("Failures")); err != nil {
+		logging.Error.Fatal(err)
+	}
+
+	table := tabwriter.NewWriter(color.Output, 0, 0, failureTablePadding, ' ', 0)
+
+	if _, err := fmt.Fprintln(table, "CITE NAME\tREASON\tSTEP\tSTATUS\tERROR\tURL"); err != nil {
+		logging.Error.Fatal(err)
+	}
+
+	for _, notArchived := range o.NotArchived {
+		citeName, reason := notArchived.CiteName, string(notArchived.Reason)
+
+		if len(notArchived.Attempts) == 0 {
+			if _, err := fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\n", citeName, reason, failureTablePlaceholder, failureTablePlaceholder, failureTablePlaceholder, failureTablePlaceholder); err != nil {
+				logging.Error.Fatal(err)
+			}
+
+			continue
+		}
+
+		for _, attempt := range notArchived.Attempts {
+			httpStatus := failureTablePlaceholder
+			if attempt.HttpStatus != nil {
+				httpStatus = strconv.Itoa(*attempt.HttpStatus)
+			}
+
+			if _, err := fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\n", citeName, reason, attempt.Step, httpStatus, orPlaceholder(attempt.ErrorClass), orPlaceholder(attempt.Url)); err != nil {
+				logging.Error.Fatal(err)
+			}
+
+			// Only the first row for each entry is labeled, so that it's
+			// easier to see where each entry starts.
+			citeName, reason = "", ""
+		}
+	}
+
+	if err := table.Flush(); err != nil {
+		logging.Error.Fatal(err)
+	}
 }
 
 func (o Output) JsonPrint() {
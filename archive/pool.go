@@ -0,0 +1,86 @@
+package archive
+
+import (
+	"context"
+	"sync"
+)
+
+type downloadFunc = func(ctx context.Context, index int) DownloadResult
+
+type indexedDownloadResult struct {
+	index  int
+	result DownloadResult
+}
+
+// downloadConcurrently calls `download` for each index in `[0, count)` using a
+// pool of `jobs` workers. Results are sent to `downloadResults` in index order
+// rather than the order they complete in, so the output doesn't depend on
+// which downloads finish first. This stops at the first error and closes
+// `downloadResults` when it's done.
+func downloadConcurrently(ctx context.Context, jobs int, count int, download downloadFunc, downloadResults chan DownloadResult) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	indices := make(chan int)
+
+	// This is buffered so that workers never block, even if we stop reading
+	// from it early because of an error.
+	completed := make(chan indexedDownloadResult, count)
+
+	var workers sync.WaitGroup
+
+	for i := 0; i < jobs; i++ {
+		workers.Add(1)
+
+		go func() {
+			defer workers.Done()
+
+			for index := range indices {
+				completed <- indexedDownloadResult{index: index, result: download(ctx, index)}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(indices)
+
+		for index := 0; index < count; index++ {
+			select {
+			case indices <- index:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		workers.Wait()
+		close(completed)
+	}()
+
+	pending := make(map[int]DownloadResult)
+	nextIndex := 0
+
+	for completedResult := range completed {
+		pending[completedResult.index] = completedResult.result
+
+		for {
+			result, ok := pending[nextIndex]
+			if !ok {
+				break
+			}
+
+			delete(pending, nextIndex)
+			nextIndex++
+
+			downloadResults <- result
+
+			if result.Error != nil {
+				close(downloadResults)
+				return
+			}
+		}
+	}
+
+	close(downloadResults)
+}
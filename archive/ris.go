@@ -0,0 +1,276 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/frawleyskid/ipfs-bib/network"
+	"github.com/nickng/bibtex"
+	"mime"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	risTypeTag            = "TY"
+	risEndTag             = "ER"
+	bibtexAuthorSeparator = " and "
+	byteOrderMark         = "\ufeff"
+)
+
+var ErrParseRis = errors.New("error parsing RIS")
+
+var risLineRegex = regexp.MustCompile(`^([A-Z][A-Z0-9])  -( (.*))?$`)
+
+// This maps RIS reference types to bibtex entry types. Types which aren't
+// listed here become `misc` entries.
+var risEntryTypes = map[string]string{
+	"ABST":   "article",
+	"BOOK":   "book",
+	"CHAP":   "incollection",
+	"CONF":   "inproceedings",
+	"CPAPER": "inproceedings",
+	"EBOOK":  "book",
+	"ECHAP":  "incollection",
+	"EJOUR":  "article",
+	"INPR":   "article",
+	"JFULL":  "article",
+	"JOUR":   "article",
+	"MGZN":   "article",
+	"MPCT":   "misc",
+	"NEWS":   "article",
+	"RPRT":   "techreport",
+	"THES":   "phdthesis",
+	"UNPB":   "unpublished",
+}
+
+type risFieldMapping struct {
+	tag   string
+	field string
+}
+
+// This maps RIS tags to bibtex fields for tags which have only one value. When
+// more than one tag maps to the same field, the first one wins, so this is a
+// slice rather than a map to keep that deterministic.
+var risSingleFields = []risFieldMapping{
+	{"AB", "abstract"},
+	{"N2", "abstract"},
+	{"CY", "address"},
+	{"DO", "doi"},
+	{"ET", "edition"},
+	{"IS", "number"},
+	{"LA", "language"},
+	{"N1", "note"},
+	{"PB", "publisher"},
+	{"T3", "series"},
+	{"VL", "volume"},
+	{"Y2", "urldate"},
+}
+
+var (
+	risTitleTags   = []string{"TI", "T1"}
+	risDateTags    = []string{"PY", "Y1", "DA"}
+	risJournalTags = []string{"T2", "JO", "JF", "JA", "J2", "BT"}
+	risAuthorTags  = []string{"AU", "A1"}
+	risEditorTags  = []string{"ED", "A2"}
+	risUrlTags     = []string{"UR"}
+	risFileTags    = []string{"L1", "L4"}
+)
+
+type risRecord struct {
+	tags map[string][]string
+}
+
+func (r risRecord) first(tags ...string) string {
+	for _, tag := range tags {
+		if values := r.tags[tag]; len(values) > 0 {
+			return values[0]
+		}
+	}
+
+	return ""
+}
+
+func (r risRecord) all(tags ...string) []string {
+	var values []string
+
+	for _, tag := range tags {
+		values = append(values, r.tags[tag]...)
+	}
+
+	return values
+}
+
+func parseRisRecords(content []byte) ([]risRecord, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+
+	var (
+		records    []risRecord
+		current    *risRecord
+		lastTag    string
+		lineNumber int
+	)
+
+	for scanner.Scan() {
+		lineNumber++
+
+		line := strings.TrimRight(strings.TrimPrefix(scanner.Text(), byteOrderMark), " \r\t")
+		if line == "" {
+			continue
+		}
+
+		matches := risLineRegex.FindStringSubmatch(line)
+		if matches == nil {
+			// Lines without a tag continue the value of the previous tag.
+			if current == nil || lastTag == "" {
+				return nil, fmt.Errorf("%w: line %d: expected a tag", ErrParseRis, lineNumber)
+			}
+
+			values := current.tags[lastTag]
+			values[len(values)-1] = strings.TrimSpace(values[len(values)-1] + " " + strings.TrimSpace(line))
+
+			continue
+		}
+
+		tag, value := matches[1], strings.TrimSpace(matches[3])
+
+		switch {
+		case tag == risTypeTag:
+			if current != nil {
+				return nil, fmt.Errorf("%w: line %d: record is missing an %s tag", ErrParseRis, lineNumber, risEndTag)
+			}
+
+			current = &risRecord{tags: make(map[string][]string)}
+			current.tags[tag] = []string{value}
+			lastTag = tag
+		case current == nil:
+			return nil, fmt.Errorf("%w: line %d: expected a %s tag", ErrParseRis, lineNumber, risTypeTag)
+		case tag == risEndTag:
+			records = append(records, *current)
+			current = nil
+			lastTag = ""
+		default:
+			current.tags[tag] = append(current.tags[tag], value)
+			lastTag = tag
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrParseRis, err)
+	}
+
+	if current != nil {
+		return nil, fmt.Errorf("%w: last record is missing an %s tag", ErrParseRis, risEndTag)
+	}
+
+	return records, nil
+}
+
+// risFileField converts the paths of attached files into the format of the
+// bibtex `file` field used by Zotero, so they can be read by
+// `ReadLocalBibSource`.
+func risFileField(paths []string) string {
+	files := make([]string, 0, len(paths))
+
+	for _, filePath := range paths {
+		filePath = strings.TrimPrefix(filePath, "file://")
+		if strings.Contains(filePath, "://") {
+			continue
+		}
+
+		mediaType := mime.TypeByExtension(filepath.Ext(filePath))
+		if mediaType == "" {
+			mediaType = network.DefaultMediaType
+		} else if parsedMediaType, _, err := mime.ParseMediaType(mediaType); err == nil {
+			mediaType = parsedMediaType
+		}
+
+		files = append(files, strings.Join([]string{filepath.Base(filePath), filePath, mediaType}, bibtexFileFieldSeparator))
+	}
+
+	return strings.Join(files, bibtexFileSeparator)
+}
+
+func (r risRecord) toBibEntry(citeNames *citeNameGenerator) *bibtex.BibEntry {
+	entryType, ok := risEntryTypes[r.first(risTypeTag)]
+	if !ok {
+		entryType = "misc"
+	}
+
+	authors := r.all(risAuthorTags...)
+	title := r.first(risTitleTags...)
+	date := r.first(risDateTags...)
+
+	var firstAuthor string
+	if len(authors) > 0 {
+		firstAuthor = authors[0]
+	}
+
+	entry := bibtex.NewBibEntry(entryType, citeNames.generate(firstAuthor, title, date))
+
+	addField := func(name, value string) {
+		if value != "" {
+			entry.AddField(name, bibtex.NewBibConst(value))
+		}
+	}
+
+	addField("title", title)
+	addField("author", strings.Join(authors, bibtexAuthorSeparator))
+	addField("editor", strings.Join(r.all(risEditorTags...), bibtexAuthorSeparator))
+	addField("year", yearRegex.FindString(date))
+
+	switch entryType {
+	case "incollection", "inproceedings":
+		addField("booktitle", r.first(risJournalTags...))
+	case "article":
+		addField("journal", r.first(risJournalTags...))
+	}
+
+	startPage, endPage := r.first("SP"), r.first("EP")
+	if startPage != "" && endPage != "" {
+		addField("pages", startPage+"--"+endPage)
+	} else {
+		addField("pages", startPage)
+	}
+
+	if serialNumber := r.first("SN"); serialNumber != "" {
+		if entryType == "book" || entryType == "incollection" {
+			addField("isbn", serialNumber)
+		} else {
+			addField("issn", serialNumber)
+		}
+	}
+
+	for _, mapping := range risSingleFields {
+		if _, exists := entry.Fields[mapping.field]; !exists {
+			addField(mapping.field, r.first(mapping.tag))
+		}
+	}
+
+	addField("keywords", strings.Join(r.all("KW"), ", "))
+	addField("url", r.first(risUrlTags...))
+	addField("file", risFileField(r.all(risFileTags...)))
+
+	return entry
+}
+
+// ParseRis parses a RIS file, as exported by EndNote, Mendeley and Zotero,
+// into bibtex entries. RIS records don't have cite names, so they are
+// generated from the first author, title and year of each record.
+func ParseRis(content []byte) (bibtex.BibTex, error) {
+	records, err := parseRisRecords(content)
+	if err != nil {
+		return bibtex.BibTex{}, err
+	}
+
+	bib := bibtex.NewBibTex()
+	citeNames := newCiteNameGenerator()
+
+	for _, record := range records {
+		bib.AddEntry(record.toBibEntry(citeNames))
+	}
+
+	return *bib, nil
+}
@@ -0,0 +1,195 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"github.com/frawleyskid/ipfs-bib/config"
+	"github.com/frawleyskid/ipfs-bib/logging"
+	"github.com/frawleyskid/ipfs-bib/network"
+	"github.com/frawleyskid/ipfs-bib/resolver"
+	"github.com/frawleyskid/ipfs-bib/store"
+	"github.com/nickng/bibtex"
+	"mime"
+	"path"
+	"sync"
+)
+
+const ContentOriginPrevious resolver.ContentOrigin = "previous"
+
+type EntryStatus string
+
+const (
+	EntryStatusAdded     EntryStatus = "added"
+	EntryStatusUnchanged EntryStatus = "unchanged"
+	EntryStatusReplaced  EntryStatus = "replaced"
+)
+
+func isWebSnapshot(location config.BibEntryLocation) bool {
+	mediaType, _, err := mime.ParseMediaType(mime.TypeByExtension(path.Ext(location.FileName)))
+	if err != nil {
+		return false
+	}
+
+	return mediaType == network.HtmlMediaType
+}
+
+// PreviousSources looks up the sources for entries which were archived in the
+// previous root passed to --update-from.
+type PreviousSources struct {
+	sourceStore        store.SourceStore
+	sourcePathTemplate config.SourcePathTemplate
+	licensePolicy      *LicensePolicy
+	journal            *Journal
+
+	// The number of entries which have been given a directory so far.
+	assignedCount int
+	lock          sync.Mutex
+}
+
+func NewPreviousSources(cfg config.Config, sourceStore store.SourceStore, journal *Journal) (*PreviousSources, error) {
+	if cfg.Flags.MaybeUpdateFrom() == nil {
+		return nil, nil //nolint:nilnil
+	}
+
+	sourcePathTemplate, err := config.NewSourcePathTemplate(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PreviousSources{
+		sourceStore:        sourceStore,
+		sourcePathTemplate: sourcePathTemplate,
+		licensePolicy:      NewLicensePolicy(cfg),
+		journal:            journal,
+	}, nil
+}
+
+// directoryName returns the directory of the entry at `index`. Entries are
+// downloaded concurrently, but they're given directories in order, the same
+// way they are when they're stored, so that entries whose directory names
+// collide are matched up with the same directories.
+func (p *PreviousSources) directoryName(entryAt func(index int) bibtex.BibEntry, index int) string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for ; p.assignedCount <= index; p.assignedCount++ {
+		p.sourcePathTemplate.Directory(entryAt(p.assignedCount))
+	}
+
+	return p.sourcePathTemplate.Directory(entryAt(index))
+}
+
+// find returns the previous source of an entry. When the directory contains
+// attachments as well as the main source, the main source is the file which was
+// recorded in the journal when it was archived. If there's no record of it, we
+// can't tell which file is the main source, so the entry is downloaded again.
+func (p *PreviousSources) find(ctx context.Context, entry bibtex.BibEntry, directoryName string) *config.BibEntryLocation {
+	location, err := p.sourceStore.PreviousSource(ctx, directoryName)
+	if err != nil {
+		logging.Verbose.Println(err)
+		return nil
+	}
+
+	if location == nil || location.FileName != "" {
+		return location
+	}
+
+	if record, ok := p.journal.ArchivedRecord(entry.CiteName, location.DirectoryCid); ok {
+		for _, file := range location.Files {
+			if file.FileCid.String() == record.FileCid {
+				location.FileCid = file.FileCid
+				location.FileName = file.FileName
+
+				return location
+			}
+		}
+	}
+
+	logging.Verbose.Println(fmt.Sprintf("Could not tell which previous file is the source for citation: %s", entry.CiteName))
+
+	return nil
+}
+
+// license returns the license of a previous source. This is the license which
+// was recorded in the journal when it was archived, if there is one, because
+// it may have come from somewhere other than the entry, like Unpaywall.
+func (p *PreviousSources) license(entry bibtex.BibEntry, location config.BibEntryLocation) *string {
+	if record, ok := p.journal.ArchivedRecord(entry.CiteName, location.DirectoryCid); ok {
+		return record.License
+	}
+
+	return config.EntryLicense(entry)
+}
+
+// wrap returns a download function which keeps the previous source for each
+// entry rather than downloading it again. The exception is when the previous
+// source was a web snapshot, in which case we still attempt the download and
+// only replace the snapshot if we find something better. If the license of
+// the previous source is no longer allowed, it isn't kept, so that it can be
+// pruned.
+func (p *PreviousSources) wrap(entryAt func(index int) bibtex.BibEntry, download downloadFunc) downloadFunc {
+	if p == nil {
+		return download
+	}
+
+	return func(ctx context.Context, index int) DownloadResult {
+		entry := entryAt(index)
+
+		location := p.find(ctx, entry, p.directoryName(entryAt, index))
+		if location == nil {
+			return download(ctx, index)
+		}
+
+		license := p.license(entry, *location)
+
+		if err := p.licensePolicy.Check(license); err != nil {
+			result := download(ctx, index)
+
+			if result.Error == nil && result.Contents.Contents == nil {
+				result.Contents.skipSource(err)
+			}
+
+			return result
+		}
+
+		mediaType := mime.TypeByExtension(path.Ext(location.FileName))
+		if mediaType == "" {
+			mediaType = network.DefaultMediaType
+		}
+
+		unchangedContents := BibContents{
+			Entry:    entry,
+			Previous: location,
+			Contents: &DownloadedContent{
+				ContentMetadata: ContentMetadata{
+					MediaType: mediaType,
+					FileName:  location.FileName,
+					Origin:    ContentOriginPrevious,
+					License:   license,
+				},
+			},
+		}
+
+		if locator, err := config.LocateEntry(entry); err == nil {
+			unchangedContents.Doi = locator.Doi
+		}
+
+		if !isWebSnapshot(*location) {
+			return DownloadResult{Contents: unchangedContents}
+		}
+
+		result := download(ctx, index)
+
+		if result.Error != nil {
+			return result
+		}
+
+		if result.Contents.Contents == nil || result.Contents.Contents.MediaType == network.HtmlMediaType {
+			result.Contents.removeContent()
+
+			return DownloadResult{Contents: unchangedContents}
+		}
+
+		return result
+	}
+}
@@ -4,26 +4,80 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/frawleyskid/ipfs-bib/cache"
 	"github.com/frawleyskid/ipfs-bib/config"
 	"github.com/frawleyskid/ipfs-bib/handler"
 	"github.com/frawleyskid/ipfs-bib/logging"
 	"github.com/frawleyskid/ipfs-bib/network"
 	"github.com/frawleyskid/ipfs-bib/resolver"
+	"github.com/frawleyskid/ipfs-bib/spool"
 	"github.com/nickng/bibtex"
-	"io"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
-	zoteroApiVersion = 3
-	apiPageLimit     = 50
+	zoteroApiVersion    = 3
+	zoteroApiUrl        = "https://api.zotero.org"
+	apiPageLimit        = 50
+	authorizationHeader = "Authorization"
 )
 
-var zoteroHeaders = map[string]string{
-	"Zotero-API-Version": strconv.Itoa(zoteroApiVersion),
+var ErrInvalidZoteroLibrary = errors.New("invalid Zotero library, expected \"user:<id>\" or \"group:<id>\"")
+
+type ZoteroLibraryType string
+
+const (
+	ZoteroLibraryUser  ZoteroLibraryType = "users"
+	ZoteroLibraryGroup ZoteroLibraryType = "groups"
+)
+
+var zoteroLibraryPrefixes = map[string]ZoteroLibraryType{
+	"user":  ZoteroLibraryUser,
+	"group": ZoteroLibraryGroup,
+}
+
+// ZoteroLibrary is either a user library or a group library.
+type ZoteroLibrary struct {
+	Type ZoteroLibraryType
+	Id   string
+}
+
+// ParseZoteroLibrary accepts a library in the form `user:<id>` or
+// `group:<id>`. A bare ID is assumed to be a group.
+func ParseZoteroLibrary(library string) (ZoteroLibrary, error) {
+	libraryType, libraryId := ZoteroLibraryGroup, library
+
+	if index := strings.Index(library, ":"); index >= 0 {
+		prefixType, ok := zoteroLibraryPrefixes[strings.ToLower(library[:index])]
+		if !ok {
+			return ZoteroLibrary{}, fmt.Errorf("%w: %s", ErrInvalidZoteroLibrary, library)
+		}
+
+		libraryType, libraryId = prefixType, library[index+1:]
+	}
+
+	if _, err := strconv.ParseUint(libraryId, 10, 64); err != nil {
+		return ZoteroLibrary{}, fmt.Errorf("%w: %s", ErrInvalidZoteroLibrary, library)
+	}
+
+	return ZoteroLibrary{Type: libraryType, Id: libraryId}, nil
+}
+
+func (l ZoteroLibrary) apiUrl(path string, query url.Values) url.URL {
+	rawApiUrl := fmt.Sprintf("%s/%s/%s/%s", zoteroApiUrl, l.Type, url.PathEscape(l.Id), path)
+
+	apiUrl, err := url.Parse(rawApiUrl)
+	if err != nil {
+		logging.Error.Fatal(fmt.Errorf("%w: %v", network.ErrInvalidApiUrl, err))
+	}
+
+	apiUrl.RawQuery = query.Encode()
+
+	return *apiUrl
 }
 
 type ZoteroLinkMode string
@@ -43,6 +97,10 @@ type ZoteroAttachment struct {
 	Url       *url.URL
 	MediaType string
 	FileName  string
+
+	// Path is the location of the attachment file when reading from a local
+	// Zotero data directory.
+	Path string
 }
 
 func (a ZoteroAttachment) IsWebPage() bool {
@@ -51,9 +109,47 @@ func (a ZoteroAttachment) IsWebPage() bool {
 
 type ZoteroKey = string
 
+// ZoteroFilter restricts which items are pulled from a Zotero library.
+type ZoteroFilter struct {
+	Collection *ZoteroKey
+	Recursive  bool
+	Tags       []string
+	ItemType   *string
+}
+
+func ZoteroFilterFromConfig(cfg config.Config) ZoteroFilter {
+	return ZoteroFilter{
+		Collection: cfg.Flags.MaybeZoteroCollection(),
+		Recursive:  cfg.Flags.ZoteroRecursive,
+		Tags:       cfg.Flags.ZoteroTags,
+		ItemType:   cfg.Flags.MaybeZoteroItemType(),
+	}
+}
+
+// query returns the API query parameters for the tag and item type filters.
+// Each tag is passed as a separate parameter, so items must have every tag.
+func (f ZoteroFilter) query() url.Values {
+	query := url.Values{}
+
+	for _, tag := range f.Tags {
+		query.Add("tag", tag)
+	}
+
+	if f.ItemType != nil {
+		query.Set("itemType", *f.ItemType)
+	}
+
+	return query
+}
+
+type zoteroCitationDataResponse struct {
+	Rights string `json:"rights"`
+}
+
 type zoteroCitationResponse struct {
-	Key ZoteroKey `json:"key"`
-	Bib string    `json:"biblatex"`
+	Key  ZoteroKey                  `json:"key"`
+	Bib  string                     `json:"biblatex"`
+	Data zoteroCitationDataResponse `json:"data"`
 }
 
 func (r zoteroCitationResponse) ParseBib() (bibtex.BibEntry, error) {
@@ -66,7 +162,15 @@ func (r zoteroCitationResponse) ParseBib() (bibtex.BibEntry, error) {
 		return bibtex.BibEntry{}, fmt.Errorf("%w: %s", network.ErrUnmarshalResponse, "invalid bibtex entry")
 	}
 
-	return *bib.Entries[0], nil
+	entry := *bib.Entries[0]
+
+	// The biblatex export doesn't include the license of the item, so we get
+	// it from the item data instead.
+	if r.Data.Rights != "" && config.BibEntryField(entry, "rights") == nil {
+		entry.Fields["rights"] = bibtex.NewBibConst(r.Data.Rights)
+	}
+
+	return entry, nil
 }
 
 type zoteroAttachmentDataResponse struct {
@@ -82,13 +186,22 @@ type zoteroAttachmentResponse struct {
 	Data zoteroAttachmentDataResponse `json:"data"`
 }
 
+type zoteroCitationEntry struct {
+	Key   ZoteroKey
+	Entry bibtex.BibEntry
+}
+
 type ZoteroCitation struct {
 	Entry       bibtex.BibEntry
 	Attachments []ZoteroAttachment
 }
 
 type ZoteroClient struct {
-	httpClient *network.HttpClient
+	httpClient    *network.HttpClient
+	downloadCache *cache.Cache
+	sourceSpool   *spool.Spool
+	library       ZoteroLibrary
+	headers       map[string]string
 }
 
 func ZoteroCitationsToBibtex(citations []ZoteroCitation) bibtex.BibTex {
@@ -101,97 +214,231 @@ func ZoteroCitationsToBibtex(citations []ZoteroCitation) bibtex.BibTex {
 	return *bib
 }
 
-func NewZoteroClient(httpClient *network.HttpClient) *ZoteroClient {
-	return &ZoteroClient{httpClient}
+func NewZoteroClient(httpClient *network.HttpClient, downloadCache *cache.Cache, sourceSpool *spool.Spool, library ZoteroLibrary, apiKey *string) *ZoteroClient {
+	headers := map[string]string{
+		"Zotero-API-Version": strconv.Itoa(zoteroApiVersion),
+	}
+
+	// We use a bearer token rather than the `Zotero-API-Key` header because
+	// the `Authorization` header isn't forwarded when file downloads are
+	// redirected to another host.
+	if apiKey != nil {
+		headers[authorizationHeader] = "Bearer " + *apiKey
+	}
+
+	return &ZoteroClient{
+		httpClient:    httpClient,
+		downloadCache: downloadCache,
+		sourceSpool:   sourceSpool,
+		library:       library,
+		headers:       headers,
+	}
 }
 
-func (c *ZoteroClient) downloadCiteList(ctx context.Context, groupId string) (map[ZoteroKey]bibtex.BibEntry, error) {
-	var citeResponseList []zoteroCitationResponse
+// downloadPages requests every page of a paginated API endpoint, passing each
+// response to `decodePage`, which returns the number of results in the page.
+// This returns the library version from the first response.
+func (c *ZoteroClient) downloadPages(ctx context.Context, path string, query url.Values, decodePage func(response *http.Response) (int, error)) (ZoteroVersion, error) {
+	var libraryVersion ZoteroVersion
 
 	startIndex := 0
 
 	for {
-		rawApiUrl := fmt.Sprintf("https://api.zotero.org/groups/%s/items?include=biblatex&start=%d&limit=%d", url.PathEscape(groupId), startIndex, apiPageLimit)
-
-		apiUrl, err := url.Parse(rawApiUrl)
-		if err != nil {
-			logging.Error.Fatal(fmt.Errorf("%w: %v", network.ErrInvalidApiUrl, err))
+		pageQuery := url.Values{}
+		for key, values := range query {
+			pageQuery[key] = values
 		}
 
-		apiResponse, err := c.httpClient.RequestWithHeaders(ctx, http.MethodGet, *apiUrl, zoteroHeaders)
+		pageQuery.Set("start", strconv.Itoa(startIndex))
+		pageQuery.Set("limit", strconv.Itoa(apiPageLimit))
+
+		apiResponse, err := c.httpClient.RequestWithHeaders(ctx, http.MethodGet, c.library.apiUrl(path, pageQuery), c.headers)
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
 
-		var currentResponseList []zoteroCitationResponse
+		if startIndex == 0 {
+			libraryVersion = parseLibraryVersion(apiResponse)
+		}
 
-		if err := network.UnmarshalJson(apiResponse, &currentResponseList); err != nil {
-			return nil, err
+		pageSize, err := decodePage(apiResponse)
+		if err != nil {
+			return 0, err
 		}
 
 		if err := apiResponse.Body.Close(); err != nil {
-			return nil, err
+			return 0, err
 		}
 
-		startIndex += len(currentResponseList)
-		citeResponseList = append(citeResponseList, currentResponseList...)
+		startIndex += pageSize
 
-		if len(currentResponseList) < apiPageLimit {
-			break
+		if pageSize < apiPageLimit {
+			return libraryVersion, nil
 		}
 	}
+}
 
-	citeMap := make(map[ZoteroKey]bibtex.BibEntry)
+type zoteroCollectionResponse struct {
+	Key ZoteroKey `json:"key"`
+}
 
-	for _, citeResponse := range citeResponseList {
-		bib, err := citeResponse.ParseBib()
+// collectionKeys returns the collection in the filter, and if the filter is
+// recursive, all of its subcollections.
+func (c *ZoteroClient) collectionKeys(ctx context.Context, filter ZoteroFilter) ([]ZoteroKey, error) {
+	if filter.Collection == nil {
+		return nil, nil
+	}
+
+	collectionKeys := []ZoteroKey{*filter.Collection}
+
+	if !filter.Recursive {
+		return collectionKeys, nil
+	}
+
+	for index := 0; index < len(collectionKeys); index++ {
+		path := fmt.Sprintf("collections/%s/collections", url.PathEscape(collectionKeys[index]))
+
+		_, err := c.downloadPages(ctx, path, nil, func(response *http.Response) (int, error) {
+			var currentResponseList []zoteroCollectionResponse
+
+			if err := network.UnmarshalJson(response, &currentResponseList); err != nil {
+				return 0, err
+			}
+
+			for _, collectionResponse := range currentResponseList {
+				collectionKeys = append(collectionKeys, collectionResponse.Key)
+			}
+
+			return len(currentResponseList), nil
+		})
 		if err != nil {
-			logging.Verbose.Println(err)
-			continue
+			return nil, err
 		}
+	}
+
+	return collectionKeys, nil
+}
+
+// itemPaths returns the API paths to request items from, which is either the
+// whole library or each collection in the filter.
+func itemPaths(collectionKeys []ZoteroKey) []string {
+	if len(collectionKeys) == 0 {
+		return []string{"items"}
+	}
 
-		citeMap[citeResponse.Key] = bib
+	paths := make([]string, len(collectionKeys))
+	for index, collectionKey := range collectionKeys {
+		paths[index] = fmt.Sprintf("collections/%s/items", url.PathEscape(collectionKey))
 	}
 
-	return citeMap, nil
+	return paths
 }
 
-func (c *ZoteroClient) downloadAttachmentList(ctx context.Context, groupId string) (map[ZoteroKey][]ZoteroAttachment, error) {
-	var attachmentResponseList []zoteroAttachmentResponse
+// downloadCiteResponses downloads the items matching the filter, and returns
+// the library version they were downloaded at.
+func (c *ZoteroClient) downloadCiteResponses(ctx context.Context, collectionKeys []ZoteroKey, filter ZoteroFilter, since *ZoteroVersion) ([]zoteroCitationResponse, ZoteroVersion, error) {
+	var (
+		citeResponseList []zoteroCitationResponse
+		libraryVersion   ZoteroVersion
+	)
 
-	startIndex := 0
+	query := filter.query()
+	query.Set("include", "biblatex,data")
 
-	for {
-		rawApiUrl := fmt.Sprintf("https://api.zotero.org/groups/%s/items?itemType=attachment&start=%d&limit=%d", url.PathEscape(groupId), startIndex, apiPageLimit)
+	if since != nil {
+		query.Set("since", strconv.Itoa(int(*since)))
+	}
+
+	// An item may be in more than one collection, so we skip items we've
+	// already seen.
+	seenKeys := make(map[ZoteroKey]struct{})
+
+	for index, path := range itemPaths(collectionKeys) {
+		pathVersion, err := c.downloadPages(ctx, path, query, func(response *http.Response) (int, error) {
+			var currentResponseList []zoteroCitationResponse
+
+			if err := network.UnmarshalJson(response, &currentResponseList); err != nil {
+				return 0, err
+			}
 
-		apiUrl, err := url.Parse(rawApiUrl)
+			for _, citeResponse := range currentResponseList {
+				if _, seen := seenKeys[citeResponse.Key]; !seen {
+					seenKeys[citeResponse.Key] = struct{}{}
+					citeResponseList = append(citeResponseList, citeResponse)
+				}
+			}
+
+			return len(currentResponseList), nil
+		})
 		if err != nil {
-			logging.Error.Fatal(fmt.Errorf("%w: %v", network.ErrInvalidApiUrl, err))
+			return nil, 0, err
 		}
 
-		apiResponse, err := c.httpClient.RequestWithHeaders(ctx, http.MethodGet, *apiUrl, zoteroHeaders)
-		if err != nil {
-			return nil, err
+		if index == 0 {
+			libraryVersion = pathVersion
 		}
+	}
 
-		var currentResponseList []zoteroAttachmentResponse
+	return citeResponseList, libraryVersion, nil
+}
 
-		if err := network.UnmarshalJson(apiResponse, &currentResponseList); err != nil {
-			return nil, err
-		}
+// downloadAttachmentResponses only filters attachments by collection.
+// Attachments don't have the tags or item type of their parent item, so
+// attachments for items which were filtered out are dropped when they're
+// matched up with their parent items instead.
+func (c *ZoteroClient) downloadAttachmentResponses(ctx context.Context, collectionKeys []ZoteroKey, since *ZoteroVersion) ([]zoteroAttachmentResponse, error) {
+	var attachmentResponseList []zoteroAttachmentResponse
 
-		if err := apiResponse.Body.Close(); err != nil {
+	query := url.Values{"itemType": {"attachment"}}
+
+	if since != nil {
+		query.Set("since", strconv.Itoa(int(*since)))
+	}
+
+	seenKeys := make(map[ZoteroKey]struct{})
+
+	for _, path := range itemPaths(collectionKeys) {
+		_, err := c.downloadPages(ctx, path, query, func(response *http.Response) (int, error) {
+			var currentResponseList []zoteroAttachmentResponse
+
+			if err := network.UnmarshalJson(response, &currentResponseList); err != nil {
+				return 0, err
+			}
+
+			for _, attachmentResponse := range currentResponseList {
+				if _, seen := seenKeys[attachmentResponse.Key]; !seen {
+					seenKeys[attachmentResponse.Key] = struct{}{}
+					attachmentResponseList = append(attachmentResponseList, attachmentResponse)
+				}
+			}
+
+			return len(currentResponseList), nil
+		})
+		if err != nil {
 			return nil, err
 		}
+	}
 
-		startIndex += len(currentResponseList)
-		attachmentResponseList = append(attachmentResponseList, currentResponseList...)
+	return attachmentResponseList, nil
+}
+
+func parseCiteList(citeResponseList []zoteroCitationResponse) []zoteroCitationEntry {
+	citeList := make([]zoteroCitationEntry, 0, len(citeResponseList))
 
-		if len(currentResponseList) < apiPageLimit {
-			break
+	for _, citeResponse := range citeResponseList {
+		bib, err := citeResponse.ParseBib()
+		if err != nil {
+			logging.Verbose.Println(err)
+			continue
 		}
+
+		citeList = append(citeList, zoteroCitationEntry{Key: citeResponse.Key, Entry: bib})
 	}
 
+	return citeList
+}
+
+func parseAttachmentMap(attachmentResponseList []zoteroAttachmentResponse) map[ZoteroKey][]ZoteroAttachment {
 	attachmentMap := make(map[ZoteroKey][]ZoteroAttachment)
 
 	for _, attachmentResponse := range attachmentResponseList {
@@ -216,26 +463,50 @@ func (c *ZoteroClient) downloadAttachmentList(ctx context.Context, groupId strin
 		attachmentMap[attachmentResponse.Data.CitationKey] = append(attachmentMap[attachmentResponse.Data.CitationKey], attachment)
 	}
 
-	return attachmentMap, nil
+	return attachmentMap
 }
 
-func (c *ZoteroClient) DownloadCitations(ctx context.Context, groupId string) ([]ZoteroCitation, error) {
-	citeMap, err := c.downloadCiteList(ctx, groupId)
+// DownloadCitations downloads the items in the library which match the
+// filter. If a previous sync of the library was saved, only the items which
+// have changed since then are downloaded.
+func (c *ZoteroClient) DownloadCitations(ctx context.Context, filter ZoteroFilter, librarySync *ZoteroSync) ([]ZoteroCitation, error) {
+	collectionKeys, err := c.collectionKeys(ctx, filter)
 	if err != nil {
 		return nil, err
 	}
 
-	attachmentMap, err := c.downloadAttachmentList(ctx, groupId)
+	previousSnapshot, err := librarySync.load()
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot zoteroLibrarySnapshot
+
+	if previousSnapshot == nil {
+		snapshot, err = c.downloadSnapshot(ctx, collectionKeys, filter)
+	} else {
+		snapshot, err = c.updateSnapshot(ctx, collectionKeys, filter, *previousSnapshot)
+	}
+
 	if err != nil {
 		return nil, err
 	}
 
-	citations := make([]ZoteroCitation, 0, len(citeMap))
+	if err := librarySync.save(snapshot); err != nil {
+		return nil, err
+	}
+
+	citeList := parseCiteList(snapshot.Citations)
+	attachmentMap := parseAttachmentMap(snapshot.Attachments)
 
-	for zoteroKey, bibEntry := range citeMap {
+	// We keep the citations in the order the API returned them so that the
+	// output is deterministic.
+	citations := make([]ZoteroCitation, 0, len(citeList))
+
+	for _, citeEntry := range citeList {
 		citation := ZoteroCitation{
-			Entry:       bibEntry,
-			Attachments: attachmentMap[zoteroKey],
+			Entry:       citeEntry.Entry,
+			Attachments: attachmentMap[citeEntry.Key],
 		}
 		citations = append(citations, citation)
 	}
@@ -243,12 +514,14 @@ func (c *ZoteroClient) DownloadCitations(ctx context.Context, groupId string) ([
 	return citations, nil
 }
 
-func (c *ZoteroClient) DownloadAttachment(ctx context.Context, groupId string, attachment ZoteroAttachment) (DownloadedContent, error) {
+func (c *ZoteroClient) DownloadAttachment(ctx context.Context, attachment ZoteroAttachment) (DownloadedContent, error) {
 	var (
 		downloadUrl *url.URL
-		err         error
+		headers     map[string]string
 	)
 
+	// Attachment URLs may point at any host, so we only send the API key to
+	// the Zotero API itself.
 	switch attachment.LinkMode {
 	case LinkModeLinkedUrl, LinkModeImportedUrl:
 		if attachment.Url == nil {
@@ -257,31 +530,45 @@ func (c *ZoteroClient) DownloadAttachment(ctx context.Context, groupId string, a
 			downloadUrl = attachment.Url
 		}
 	case LinkModeLinkedFile, LinkModeImportedFile:
-		rawApiUrl := fmt.Sprintf("https://api.zotero.org/groups/%s/items/%s/file", url.PathEscape(groupId), url.PathEscape(attachment.Key))
+		apiUrl := c.library.apiUrl(fmt.Sprintf("items/%s/file", url.PathEscape(attachment.Key)), nil)
+		downloadUrl, headers = &apiUrl, c.headers
+	default:
+		return DownloadedContent{}, ErrNoSource
+	}
+
+	cacheKey := cache.Key{Url: *downloadUrl}
 
-		downloadUrl, err = url.Parse(rawApiUrl)
+	var (
+		content *spool.File
+		header  http.Header
+	)
+
+	if cacheEntry, ok := c.downloadCache.Get(cacheKey); ok {
+		content, header = cacheEntry.Body, cacheEntry.Header
+	} else {
+		downloadResponse, err := c.httpClient.RequestWithHeaders(ctx, http.MethodGet, *downloadUrl, headers)
 		if err != nil {
-			logging.Error.Fatal(fmt.Errorf("%w: %v", network.ErrInvalidApiUrl, err))
+			return DownloadedContent{}, err
 		}
-	}
 
-	downloadResponse, err := c.httpClient.RequestWithHeaders(ctx, http.MethodGet, *downloadUrl, zoteroHeaders)
-	if err != nil {
-		return DownloadedContent{}, err
-	}
+		content, err = handler.SpoolResponse(c.sourceSpool, downloadResponse, &attachment.MediaType)
+		if err != nil {
+			return DownloadedContent{}, err
+		}
 
-	content, err := io.ReadAll(downloadResponse.Body)
-	if err != nil {
-		return DownloadedContent{}, fmt.Errorf("%w: %v", network.ErrHttp, err)
-	}
+		header = downloadResponse.Header
 
-	if err := downloadResponse.Body.Close(); err != nil {
-		return DownloadedContent{}, fmt.Errorf("%w: %v", network.ErrHttp, err)
+		c.downloadCache.Put(cacheKey, cache.Entry{
+			Url:       *downloadUrl,
+			Header:    header,
+			MediaType: attachment.MediaType,
+			Body:      content,
+		})
 	}
 
 	filename := attachment.FileName
 	if filename == "" {
-		filename = config.InferFileName(attachment.Url, attachment.MediaType, downloadResponse.Header)
+		filename = config.InferFileName(attachment.Url, attachment.MediaType, header)
 	}
 
 	return DownloadedContent{
@@ -294,23 +581,33 @@ func (c *ZoteroClient) DownloadAttachment(ctx context.Context, groupId string, a
 	}, nil
 }
 
-func FromZotero(ctx context.Context, cfg config.Config, groupId string, bibResult chan BibtexResult, downloadResults chan DownloadResult) {
-	httpClient := network.NewClient(cfg.File.Archive.UserAgent)
-
-	zoteroClient := NewZoteroClient(httpClient)
-
-	downloadClient := NewDownloadClient(httpClient)
+func FromZotero(ctx context.Context, cfg config.Config, rawLibrary string, journal *Journal, previousSources *PreviousSources, budget *Budget, sourceSpool *spool.Spool, bibResult chan BibtexResult, downloadResults chan DownloadResult) {
+	httpClient := NewHttpClient(cfg)
 
-	downloadHandler := handler.FromConfig(cfg)
+	downloadCache, err := cache.FromConfig(cfg, sourceSpool)
+	if err != nil {
+		downloadResults <- DownloadResult{Error: err}
+		close(downloadResults)
+		return
+	}
 
-	sourceResolver, err := resolver.FromConfig(cfg)
+	library, err := ParseZoteroLibrary(rawLibrary)
 	if err != nil {
 		downloadResults <- DownloadResult{Error: err}
 		close(downloadResults)
 		return
 	}
 
-	citations, err := zoteroClient.DownloadCitations(ctx, groupId)
+	zoteroClient := NewZoteroClient(httpClient, downloadCache, sourceSpool, library, cfg.File.Zotero.MaybeApiKey())
+
+	filter := ZoteroFilterFromConfig(cfg)
+
+	var librarySync *ZoteroSync
+	if stateDir := cfg.Flags.MaybeStateDir(); stateDir != nil {
+		librarySync = NewZoteroSync(*stateDir, library, filter)
+	}
+
+	citations, err := zoteroClient.DownloadCitations(ctx, filter, librarySync)
 	if err != nil {
 		downloadResults <- DownloadResult{Error: err}
 		close(downloadResults)
@@ -320,8 +617,38 @@ func FromZotero(ctx context.Context, cfg config.Config, groupId string, bibResul
 	bib := ZoteroCitationsToBibtex(citations)
 	bibResult <- BibtexResult{Bib: bib}
 
-citeMap:
-	for _, citation := range citations {
+	downloadZoteroCitations(ctx, cfg, httpClient, downloadCache, sourceSpool, citations, zoteroClient, journal, previousSources, budget, downloadResults)
+}
+
+// zoteroAttachmentDownloader gets the contents of Zotero attachments, either
+// from the Zotero API or from a local Zotero data directory.
+type zoteroAttachmentDownloader interface {
+	DownloadAttachment(ctx context.Context, attachment ZoteroAttachment) (DownloadedContent, error)
+}
+
+func downloadZoteroCitations(ctx context.Context, cfg config.Config, httpClient *network.HttpClient, downloadCache *cache.Cache, sourceSpool *spool.Spool, citations []ZoteroCitation, attachmentDownloader zoteroAttachmentDownloader, journal *Journal, previousSources *PreviousSources, budget *Budget, downloadResults chan DownloadResult) {
+	licensePolicy := NewLicensePolicy(cfg)
+
+	downloadClient := NewDownloadClient(httpClient, downloadCache, licensePolicy, sourceSpool)
+
+	downloadHandler := handler.FromConfig(cfg, httpClient, sourceSpool)
+
+	sourceResolver, err := resolver.FromConfig(cfg, httpClient)
+	if err != nil {
+		downloadResults <- DownloadResult{Error: err}
+		close(downloadResults)
+		return
+	}
+
+	entries := make([]*bibtex.BibEntry, len(citations))
+	for index := range citations {
+		entries[index] = &citations[index].Entry
+	}
+
+	NewEnricher(cfg, httpClient).EnrichAll(ctx, cfg.Jobs(), entries)
+
+	download := func(ctx context.Context, index int) DownloadResult {
+		citation := citations[index]
 		bibContent := BibContents{Entry: citation.Entry}
 
 		var sourceLocator *config.SourceLocator
@@ -329,15 +656,75 @@ citeMap:
 		switch locator, err := config.LocateEntry(citation.Entry); {
 		case errors.Is(err, config.ErrCouldNotLocateEntry):
 			logging.Verbose.Println(err)
+			bibContent.record(Attempt{Step: AttemptStepLocate, Err: err})
 		case err != nil:
-			downloadResults <- DownloadResult{Error: err}
-			close(downloadResults)
-			return
+			return DownloadResult{Error: err}
 		default:
 			sourceLocator = &locator
 			bibContent.Doi = locator.Doi
 		}
 
+		if contents, attachments, ok := journal.Restore(citation.Entry.CiteName, sourceLocator, sourceSpool); ok && licensePolicy.Check(contents.License) == nil {
+			bibContent.Contents = &contents
+			bibContent.Attachments = attachments
+			return DownloadResult{Contents: bibContent}
+		}
+
+		// Zotero doesn't know the license of attachments, so the license of
+		// the item applies.
+		downloadAttachment := func(attachment ZoteroAttachment) (DownloadedContent, error) {
+			start := time.Now()
+
+			contents, err := attachmentDownloader.DownloadAttachment(ctx, attachment)
+			if err == nil {
+				contents.License = config.EntryLicense(citation.Entry)
+
+				if err = licensePolicy.Check(contents.License); err != nil {
+					contents.Content.Remove()
+				}
+			}
+
+			bibContent.record(newAttempt(AttemptStep(ContentOriginZotero), attachment.Url, start, err))
+
+			if err != nil {
+				return DownloadedContent{}, err
+			}
+
+			return contents, nil
+		}
+
+		// Attachments which were already tried aren't downloaded again when
+		// every attachment is archived.
+		triedAttachments := make(map[ZoteroKey]struct{})
+
+		// found archives every other attachment alongside the main source if
+		// that's enabled.
+		found := func(contents DownloadedContent) DownloadResult {
+			bibContent.Contents = &contents
+
+			if !cfg.File.Zotero.AllAttachments {
+				return DownloadResult{Contents: bibContent}
+			}
+
+			for _, attachment := range citation.Attachments {
+				if _, tried := triedAttachments[attachment.Key]; tried {
+					continue
+				}
+
+				if attachment.IsWebPage() && !cfg.File.Snapshot.ZoteroAttachment {
+					continue
+				}
+
+				// Failures are recorded as attempts, but they don't stop the
+				// entry from being archived.
+				if attachmentContents, err := downloadAttachment(attachment); err == nil {
+					bibContent.Attachments = append(bibContent.Attachments, attachmentContents)
+				}
+			}
+
+			return DownloadResult{Contents: bibContent}
+		}
+
 		var firstWebSnapshotAttachment *ZoteroAttachment
 
 		for i, attachment := range citation.Attachments {
@@ -346,43 +733,45 @@ citeMap:
 					firstWebSnapshotAttachment = &citation.Attachments[i]
 				}
 			} else {
-				contents, err := zoteroClient.DownloadAttachment(ctx, groupId, attachment)
+				triedAttachments[attachment.Key] = struct{}{}
+
+				contents, err := downloadAttachment(attachment)
 				if err == nil {
-					bibContent.Contents = &contents
-					downloadResults <- DownloadResult{Contents: bibContent}
-					continue citeMap
-				} else if !errors.Is(err, ErrNoSource) {
-					logging.Verbose.Println(err)
+					return found(contents)
 				}
+
+				bibContent.skipSource(err)
 			}
 		}
 
 		if sourceLocator != nil {
-			contents, err := downloadClient.Download(ctx, *sourceLocator, downloadHandler, sourceResolver)
+			contents, err := downloadClient.Download(ctx, *sourceLocator, downloadHandler, sourceResolver, bibContent.record)
 			if err == nil {
-				bibContent.Contents = &contents
-				downloadResults <- DownloadResult{Contents: bibContent}
-				continue
-			} else if !errors.Is(err, ErrNoSource) {
-				logging.Verbose.Println(err)
+				return found(contents)
 			}
+
+			bibContent.skipSource(err)
 		}
 
 		if cfg.File.Snapshot.ZoteroAttachment && firstWebSnapshotAttachment != nil {
-			contents, err := zoteroClient.DownloadAttachment(ctx, groupId, *firstWebSnapshotAttachment)
+			triedAttachments[firstWebSnapshotAttachment.Key] = struct{}{}
+
+			contents, err := downloadAttachment(*firstWebSnapshotAttachment)
 			if err == nil {
-				bibContent.Contents = &contents
-				downloadResults <- DownloadResult{Contents: bibContent}
-				continue citeMap
-			} else if !errors.Is(err, ErrNoSource) {
-				logging.Verbose.Println(err)
+				return found(contents)
 			}
+
+			bibContent.skipSource(err)
 		}
 
-		downloadResults <- DownloadResult{Contents: bibContent}
+		bibContent.logNotArchived()
+
+		return DownloadResult{Contents: bibContent}
+	}
 
-		logging.Error.Println(fmt.Sprintf("Could not find a source for citation: %s", citation.Entry.CiteName))
+	entryAt := func(index int) bibtex.BibEntry {
+		return citations[index].Entry
 	}
 
-	close(downloadResults)
+	downloadConcurrently(ctx, cfg.Jobs(), len(citations), previousSources.wrap(entryAt, budget.wrap(entryAt, download)), downloadResults)
 }
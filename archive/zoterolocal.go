@@ -0,0 +1,688 @@
+package archive
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/frawleyskid/ipfs-bib/cache"
+	"github.com/frawleyskid/ipfs-bib/config"
+	"github.com/frawleyskid/ipfs-bib/logging"
+	"github.com/frawleyskid/ipfs-bib/network"
+	"github.com/frawleyskid/ipfs-bib/spool"
+	"github.com/nickng/bibtex"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	// This registers the pure Go SQLite driver.
+	_ "modernc.org/sqlite"
+)
+
+const (
+	zoteroDatabaseFileName = "zotero.sqlite"
+	zoteroStorageDirName   = "storage"
+	zoteroStoragePrefix    = "storage:"
+	zoteroSingleFieldMode  = 1
+)
+
+var ErrZoteroDatabase = errors.New("could not read Zotero database")
+
+// These are the values of `itemAttachments.linkMode` in the Zotero database.
+var zoteroDatabaseLinkModes = map[int]ZoteroLinkMode{
+	0: LinkModeImportedFile,
+	1: LinkModeImportedUrl,
+	2: LinkModeLinkedFile,
+	3: LinkModeLinkedUrl,
+}
+
+// This maps Zotero item types to bibtex entry types. Types which aren't listed
+// here become `misc` entries.
+var zoteroEntryTypes = map[string]string{
+	"book":             "book",
+	"bookSection":      "incollection",
+	"conferencePaper":  "inproceedings",
+	"journalArticle":   "article",
+	"magazineArticle":  "article",
+	"manuscript":       "unpublished",
+	"newspaperArticle": "article",
+	"preprint":         "article",
+	"report":           "techreport",
+	"thesis":           "phdthesis",
+	"webpage":          "online",
+}
+
+// This maps Zotero fields to bibtex fields.
+var zoteroBibtexFields = []struct {
+	zotero string
+	bibtex string
+}{
+	{"title", "title"},
+	{"volume", "volume"},
+	{"issue", "number"},
+	{"pages", "pages"},
+	{"edition", "edition"},
+	{"series", "series"},
+	{"publisher", "publisher"},
+	{"place", "address"},
+	{"university", "school"},
+	{"institution", "institution"},
+	{"DOI", "doi"},
+	{"url", "url"},
+	{"ISBN", "isbn"},
+	{"ISSN", "issn"},
+	{"abstractNote", "abstract"},
+	{"language", "language"},
+	{"rights", "rights"},
+	{"extra", "note"},
+}
+
+// These fields contain the title of the journal, book or proceedings an item
+// was published in.
+var zoteroContainerFields = []string{"publicationTitle", "bookTitle", "proceedingsTitle", "websiteTitle"}
+
+type zoteroLocalItem struct {
+	id       int64
+	key      ZoteroKey
+	itemType string
+	fields   map[string]string
+	creators map[string][]string
+}
+
+func (i zoteroLocalItem) toBibEntry(citeNames *citeNameGenerator) *bibtex.BibEntry {
+	entryType, ok := zoteroEntryTypes[i.itemType]
+	if !ok {
+		entryType = "misc"
+	}
+
+	// Recent versions of Zotero have a citation key field. Otherwise, we
+	// generate one the same way Zotero does when exporting bibtex.
+	citeName := i.fields["citationKey"]
+	if citeName == "" {
+		var firstAuthor string
+		if authors := i.creators["author"]; len(authors) > 0 {
+			firstAuthor = authors[0]
+		}
+
+		citeName = citeNames.generate(firstAuthor, i.fields["title"], i.fields["date"])
+	}
+
+	entry := bibtex.NewBibEntry(entryType, citeName)
+
+	addField := func(name, value string) {
+		if value != "" {
+			entry.AddField(name, bibtex.NewBibConst(value))
+		}
+	}
+
+	for _, field := range zoteroBibtexFields {
+		addField(field.bibtex, i.fields[field.zotero])
+	}
+
+	for _, containerField := range zoteroContainerFields {
+		if containerTitle := i.fields[containerField]; containerTitle != "" {
+			switch entryType {
+			case "incollection", "inproceedings":
+				addField("booktitle", containerTitle)
+			case "article":
+				addField("journal", containerTitle)
+			}
+
+			break
+		}
+	}
+
+	addField("author", strings.Join(i.creators["author"], bibtexAuthorSeparator))
+	addField("editor", strings.Join(i.creators["editor"], bibtexAuthorSeparator))
+	addField("year", yearRegex.FindString(i.fields["date"]))
+
+	// Zotero stores access dates as `YYYY-MM-DD HH:MM:SS`.
+	if accessDate := i.fields["accessDate"]; accessDate != "" {
+		addField("urldate", strings.Fields(accessDate)[0])
+	}
+
+	return entry
+}
+
+// zoteroDatabase reads items from a copy of a Zotero database.
+type zoteroDatabase struct {
+	db        *sql.DB
+	dataDir   string
+	copyPath  string
+	libraryId int64
+}
+
+// openZoteroDatabase copies the database before opening it, because Zotero
+// holds an exclusive lock on it while it's running.
+func openZoteroDatabase(dataDir string) (*zoteroDatabase, error) {
+	databaseFile, err := os.Open(filepath.Join(dataDir, zoteroDatabaseFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	defer databaseFile.Close()
+
+	copyFile, err := ioutil.TempFile("", "ipfs-bib-zotero-*.sqlite")
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.Copy(copyFile, databaseFile); err != nil {
+		copyFile.Close()
+		os.Remove(copyFile.Name())
+		return nil, err
+	}
+
+	if err := copyFile.Close(); err != nil {
+		os.Remove(copyFile.Name())
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?mode=ro", copyFile.Name()))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrZoteroDatabase, err)
+	}
+
+	return &zoteroDatabase{
+		db:       db,
+		dataDir:  dataDir,
+		copyPath: copyFile.Name(),
+	}, nil
+}
+
+func (d *zoteroDatabase) Close() error {
+	if err := d.db.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(d.copyPath)
+}
+
+// selectLibrary picks the user library if `rawLibrary` is empty or a user
+// library, or otherwise the group library with the given ID.
+func (d *zoteroDatabase) selectLibrary(rawLibrary string) error {
+	libraryType := ZoteroLibraryUser
+
+	var groupId string
+
+	if rawLibrary != "" {
+		library, err := ParseZoteroLibrary(rawLibrary)
+		if err != nil {
+			return err
+		}
+
+		libraryType, groupId = library.Type, library.Id
+	}
+
+	var row *sql.Row
+
+	if libraryType == ZoteroLibraryUser {
+		row = d.db.QueryRow("SELECT libraryID FROM libraries WHERE type = 'user'")
+	} else {
+		row = d.db.QueryRow("SELECT libraryID FROM groups WHERE groupID = ?", groupId)
+	}
+
+	if err := row.Scan(&d.libraryId); errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: library not found: %s", ErrZoteroDatabase, rawLibrary)
+	} else if err != nil {
+		return fmt.Errorf("%w: %v", ErrZoteroDatabase, err)
+	}
+
+	return nil
+}
+
+// readFields returns the fields of every item in the library, including
+// attachments.
+func (d *zoteroDatabase) readFields() (map[int64]map[string]string, error) {
+	rows, err := d.db.Query(`
+		SELECT itemData.itemID, fieldsCombined.fieldName, itemDataValues.value
+		FROM itemData
+		JOIN fieldsCombined USING (fieldID)
+		JOIN itemDataValues USING (valueID)
+		JOIN items USING (itemID)
+		WHERE items.libraryID = ?`, d.libraryId)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrZoteroDatabase, err)
+	}
+
+	defer rows.Close()
+
+	fields := make(map[int64]map[string]string)
+
+	for rows.Next() {
+		var (
+			itemId           int64
+			fieldName, value string
+		)
+
+		if err := rows.Scan(&itemId, &fieldName, &value); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrZoteroDatabase, err)
+		}
+
+		if fields[itemId] == nil {
+			fields[itemId] = make(map[string]string)
+		}
+
+		fields[itemId][fieldName] = value
+	}
+
+	return fields, rows.Err()
+}
+
+// readCreators returns the names of the creators of every item in the
+// library, grouped by creator type and in order.
+func (d *zoteroDatabase) readCreators() (map[int64]map[string][]string, error) {
+	rows, err := d.db.Query(`
+		SELECT itemCreators.itemID, creators.firstName, creators.lastName, creators.fieldMode, creatorTypes.creatorType
+		FROM itemCreators
+		JOIN creators USING (creatorID)
+		JOIN creatorTypes USING (creatorTypeID)
+		JOIN items USING (itemID)
+		WHERE items.libraryID = ?
+		ORDER BY itemCreators.itemID, itemCreators.orderIndex`, d.libraryId)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrZoteroDatabase, err)
+	}
+
+	defer rows.Close()
+
+	creators := make(map[int64]map[string][]string)
+
+	for rows.Next() {
+		var (
+			itemId                           int64
+			firstName, lastName, creatorType string
+			fieldMode                        int
+		)
+
+		if err := rows.Scan(&itemId, &firstName, &lastName, &fieldMode, &creatorType); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrZoteroDatabase, err)
+		}
+
+		name := lastName
+		if fieldMode != zoteroSingleFieldMode && firstName != "" {
+			name = lastName + ", " + firstName
+		}
+
+		if creators[itemId] == nil {
+			creators[itemId] = make(map[string][]string)
+		}
+
+		creators[itemId][creatorType] = append(creators[itemId][creatorType], name)
+	}
+
+	return creators, rows.Err()
+}
+
+func (d *zoteroDatabase) readItems(fields map[int64]map[string]string, creators map[int64]map[string][]string) ([]zoteroLocalItem, error) {
+	rows, err := d.db.Query(`
+		SELECT items.itemID, items.key, itemTypes.typeName
+		FROM items
+		JOIN itemTypes USING (itemTypeID)
+		WHERE items.libraryID = ?
+		AND items.itemID NOT IN (SELECT itemID FROM deletedItems)
+		AND itemTypes.typeName NOT IN ('attachment', 'note', 'annotation')
+		ORDER BY items.itemID`, d.libraryId)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrZoteroDatabase, err)
+	}
+
+	defer rows.Close()
+
+	var items []zoteroLocalItem
+
+	for rows.Next() {
+		var item zoteroLocalItem
+
+		if err := rows.Scan(&item.id, &item.key, &item.itemType); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrZoteroDatabase, err)
+		}
+
+		item.fields = fields[item.id]
+		item.creators = creators[item.id]
+
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+// attachmentPath returns the location of an attachment file. Linked files
+// which are relative to the base attachment directory can't be found, because
+// that's configured in the Zotero preferences rather than the database.
+func (d *zoteroDatabase) attachmentPath(key ZoteroKey, linkMode ZoteroLinkMode, rawPath string) string {
+	switch linkMode {
+	case LinkModeImportedFile, LinkModeImportedUrl:
+		if strings.HasPrefix(rawPath, zoteroStoragePrefix) {
+			return filepath.Join(d.dataDir, zoteroStorageDirName, key, strings.TrimPrefix(rawPath, zoteroStoragePrefix))
+		}
+	case LinkModeLinkedFile:
+		if filepath.IsAbs(rawPath) {
+			return rawPath
+		}
+	case LinkModeLinkedUrl:
+	}
+
+	return ""
+}
+
+func (d *zoteroDatabase) readAttachments(fields map[int64]map[string]string) (map[int64][]ZoteroAttachment, error) {
+	rows, err := d.db.Query(`
+		SELECT items.itemID, items.key, itemAttachments.parentItemID, itemAttachments.linkMode, itemAttachments.contentType, itemAttachments.path
+		FROM itemAttachments
+		JOIN items USING (itemID)
+		WHERE items.libraryID = ?
+		AND items.itemID NOT IN (SELECT itemID FROM deletedItems)
+		AND itemAttachments.parentItemID IS NOT NULL
+		ORDER BY items.itemID`, d.libraryId)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrZoteroDatabase, err)
+	}
+
+	defer rows.Close()
+
+	attachments := make(map[int64][]ZoteroAttachment)
+
+	for rows.Next() {
+		var (
+			itemId, parentId     int64
+			key                  ZoteroKey
+			rawLinkMode          int
+			contentType, rawPath sql.NullString
+		)
+
+		if err := rows.Scan(&itemId, &key, &parentId, &rawLinkMode, &contentType, &rawPath); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrZoteroDatabase, err)
+		}
+
+		linkMode := zoteroDatabaseLinkModes[rawLinkMode]
+		localPath := d.attachmentPath(key, linkMode, rawPath.String)
+
+		var attachmentUrl *url.URL
+		if rawUrl := fields[itemId]["url"]; rawUrl != "" {
+			attachmentUrl, err = url.Parse(rawUrl)
+			if err != nil {
+				attachmentUrl = nil
+			}
+		}
+
+		mediaType := contentType.String
+		if mediaType == "" {
+			mediaType = network.DefaultMediaType
+		}
+
+		attachments[parentId] = append(attachments[parentId], ZoteroAttachment{
+			Key:       key,
+			LinkMode:  linkMode,
+			Url:       attachmentUrl,
+			MediaType: mediaType,
+			FileName:  filepath.Base(localPath),
+			Path:      localPath,
+		})
+	}
+
+	return attachments, rows.Err()
+}
+
+// collectionItemIds returns the IDs of the items in the collection passed in
+// the filter, and optionally in its subcollections. This returns nil if
+// there's no collection filter.
+func (d *zoteroDatabase) collectionItemIds(filter ZoteroFilter) (map[int64]struct{}, error) {
+	if filter.Collection == nil {
+		return nil, nil
+	}
+
+	var collectionId int64
+
+	row := d.db.QueryRow("SELECT collectionID FROM collections WHERE key = ? AND libraryID = ?", *filter.Collection, d.libraryId)
+	if err := row.Scan(&collectionId); errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: collection not found: %s", ErrZoteroDatabase, *filter.Collection)
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrZoteroDatabase, err)
+	}
+
+	query := "SELECT itemID FROM collectionItems WHERE collectionID = ?"
+	if filter.Recursive {
+		query = `
+			WITH RECURSIVE subcollections(collectionID) AS (
+				SELECT ?
+				UNION SELECT collections.collectionID FROM collections JOIN subcollections ON collections.parentCollectionID = subcollections.collectionID
+			)
+			SELECT itemID FROM collectionItems WHERE collectionID IN (SELECT collectionID FROM subcollections)`
+	}
+
+	rows, err := d.db.Query(query, collectionId)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrZoteroDatabase, err)
+	}
+
+	defer rows.Close()
+
+	itemIds := make(map[int64]struct{})
+
+	for rows.Next() {
+		var itemId int64
+
+		if err := rows.Scan(&itemId); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrZoteroDatabase, err)
+		}
+
+		itemIds[itemId] = struct{}{}
+	}
+
+	return itemIds, rows.Err()
+}
+
+func (d *zoteroDatabase) itemTags() (map[int64]map[string]struct{}, error) {
+	rows, err := d.db.Query("SELECT itemTags.itemID, tags.name FROM itemTags JOIN tags USING (tagID)")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrZoteroDatabase, err)
+	}
+
+	defer rows.Close()
+
+	tags := make(map[int64]map[string]struct{})
+
+	for rows.Next() {
+		var (
+			itemId int64
+			name   string
+		)
+
+		if err := rows.Scan(&itemId, &name); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrZoteroDatabase, err)
+		}
+
+		if tags[itemId] == nil {
+			tags[itemId] = make(map[string]struct{})
+		}
+
+		tags[itemId][name] = struct{}{}
+	}
+
+	return tags, rows.Err()
+}
+
+// matchesItemType accepts the same syntax as the `itemType` parameter of the
+// Zotero API, like `book || bookSection` or `-note`.
+func matchesItemType(itemType string, filter string) bool {
+	if strings.HasPrefix(filter, "-") {
+		return !matchesItemType(itemType, strings.TrimPrefix(filter, "-"))
+	}
+
+	for _, option := range strings.Split(filter, "||") {
+		if strings.TrimSpace(option) == itemType {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (d *zoteroDatabase) filterItems(items []zoteroLocalItem, filter ZoteroFilter) ([]zoteroLocalItem, error) {
+	collectionItemIds, err := d.collectionItemIds(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var tags map[int64]map[string]struct{}
+
+	if len(filter.Tags) > 0 {
+		tags, err = d.itemTags()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	filteredItems := make([]zoteroLocalItem, 0, len(items))
+
+	for _, item := range items {
+		if collectionItemIds != nil {
+			if _, ok := collectionItemIds[item.id]; !ok {
+				continue
+			}
+		}
+
+		if filter.ItemType != nil && !matchesItemType(item.itemType, *filter.ItemType) {
+			continue
+		}
+
+		hasTags := true
+
+		for _, tag := range filter.Tags {
+			if _, ok := tags[item.id][tag]; !ok {
+				hasTags = false
+				break
+			}
+		}
+
+		if hasTags {
+			filteredItems = append(filteredItems, item)
+		}
+	}
+
+	return filteredItems, nil
+}
+
+// ReadCitations reads the items in the library which match the filter, along
+// with their attachments.
+func (d *zoteroDatabase) ReadCitations(filter ZoteroFilter) ([]ZoteroCitation, error) {
+	fields, err := d.readFields()
+	if err != nil {
+		return nil, err
+	}
+
+	creators, err := d.readCreators()
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := d.readItems(fields, creators)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err = d.filterItems(items, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	attachments, err := d.readAttachments(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	citeNames := newCiteNameGenerator()
+	citations := make([]ZoteroCitation, 0, len(items))
+
+	for _, item := range items {
+		citations = append(citations, ZoteroCitation{
+			Entry:       *item.toBibEntry(citeNames),
+			Attachments: attachments[item.id],
+		})
+	}
+
+	return citations, nil
+}
+
+// ZoteroLocalStorage reads attachments from a local Zotero data directory
+// rather than downloading them. Attachments are read where they are rather
+// than copied into the spool.
+type ZoteroLocalStorage struct {
+	sourceSpool *spool.Spool
+}
+
+func NewZoteroLocalStorage(sourceSpool *spool.Spool) ZoteroLocalStorage {
+	return ZoteroLocalStorage{sourceSpool}
+}
+
+func (s ZoteroLocalStorage) DownloadAttachment(_ context.Context, attachment ZoteroAttachment) (DownloadedContent, error) {
+	if attachment.Path == "" {
+		return DownloadedContent{}, ErrNoSource
+	}
+
+	content, err := s.sourceSpool.Borrow(attachment.Path, attachment.MediaType)
+	if errors.Is(err, os.ErrNotExist) {
+		logging.Verbose.Println(fmt.Sprintf("Local Zotero attachment does not exist: %s", attachment.Path))
+		return DownloadedContent{}, ErrNoSource
+	} else if err != nil {
+		return DownloadedContent{}, err
+	}
+
+	return DownloadedContent{
+		Content: content,
+		ContentMetadata: ContentMetadata{
+			MediaType: attachment.MediaType,
+			Origin:    ContentOriginZotero,
+			FileName:  attachment.FileName,
+		},
+	}, nil
+}
+
+// ReadZoteroDatabase reads the citations in a library from a local Zotero
+// data directory. The library is either empty for the user library or
+// `group:<id>`.
+func ReadZoteroDatabase(dataDir string, rawLibrary string, filter ZoteroFilter) (citations []ZoteroCitation, err error) {
+	database, err := openZoteroDatabase(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if closeErr := database.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	if err := database.selectLibrary(rawLibrary); err != nil {
+		return nil, err
+	}
+
+	return database.ReadCitations(filter)
+}
+
+func FromZoteroLocal(ctx context.Context, cfg config.Config, dataDir string, rawLibrary string, journal *Journal, previousSources *PreviousSources, budget *Budget, sourceSpool *spool.Spool, bibResult chan BibtexResult, downloadResults chan DownloadResult) {
+	httpClient := NewHttpClient(cfg)
+
+	downloadCache, err := cache.FromConfig(cfg, sourceSpool)
+	if err != nil {
+		downloadResults <- DownloadResult{Error: err}
+		close(downloadResults)
+		return
+	}
+
+	citations, err := ReadZoteroDatabase(dataDir, rawLibrary, ZoteroFilterFromConfig(cfg))
+	if err != nil {
+		downloadResults <- DownloadResult{Error: err}
+		close(downloadResults)
+		return
+	}
+
+	bib := ZoteroCitationsToBibtex(citations)
+	bibResult <- BibtexResult{Bib: bib}
+
+	downloadZoteroCitations(ctx, cfg, httpClient, downloadCache, sourceSpool, citations, NewZoteroLocalStorage(sourceSpool), journal, previousSources, budget, downloadResults)
+}
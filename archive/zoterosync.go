@@ -0,0 +1,281 @@
+package archive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/frawleyskid/ipfs-bib/logging"
+	"github.com/frawleyskid/ipfs-bib/network"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	lastModifiedVersionHeader = "Last-Modified-Version"
+	zoteroSyncDirName         = "zotero"
+)
+
+var ErrInvalidZoteroSync = errors.New("could not parse Zotero sync state")
+
+type ZoteroVersion int
+
+func parseLibraryVersion(response *http.Response) ZoteroVersion {
+	version, err := strconv.Atoi(response.Header.Get(lastModifiedVersionHeader))
+	if err != nil {
+		return 0
+	}
+
+	return ZoteroVersion(version)
+}
+
+// zoteroLibrarySnapshot is the API responses for every item in the library
+// matching a filter, as of a library version.
+type zoteroLibrarySnapshot struct {
+	Version     ZoteroVersion              `json:"version"`
+	Citations   []zoteroCitationResponse   `json:"citations"`
+	Attachments []zoteroAttachmentResponse `json:"attachments"`
+}
+
+type zoteroDeletedResponse struct {
+	Items []ZoteroKey `json:"items"`
+}
+
+// ZoteroSync persists a snapshot of a Zotero library in the state directory,
+// so that later runs only need to download the items which have changed. A
+// separate snapshot is kept for each library and filter. The format is
+// documented in `docs/state.md`.
+type ZoteroSync struct {
+	path string
+}
+
+func NewZoteroSync(stateDir string, library ZoteroLibrary, filter ZoteroFilter) *ZoteroSync {
+	marshalledFilter, err := json.Marshal(filter)
+	if err != nil {
+		logging.Error.Fatal(err)
+	}
+
+	filterHash := sha256.Sum256(marshalledFilter)
+	fileName := fmt.Sprintf("%s-%s-%s.json", library.Type, library.Id, hex.EncodeToString(filterHash[:])[:16])
+
+	return &ZoteroSync{path: filepath.Join(stateDir, zoteroSyncDirName, fileName)}
+}
+
+func (s *ZoteroSync) load() (*zoteroLibrarySnapshot, error) {
+	if s == nil {
+		return nil, nil //nolint:nilnil
+	}
+
+	marshalledSnapshot, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil //nolint:nilnil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var snapshot zoteroLibrarySnapshot
+
+	// If the snapshot is corrupted, we can always just download the whole
+	// library again.
+	if err := json.Unmarshal(marshalledSnapshot, &snapshot); err != nil {
+		logging.Verbose.Println(fmt.Errorf("%w: %v", ErrInvalidZoteroSync, err))
+		return nil, nil //nolint:nilnil
+	}
+
+	return &snapshot, nil
+}
+
+func (s *ZoteroSync) save(snapshot zoteroLibrarySnapshot) error {
+	if s == nil {
+		return nil
+	}
+
+	marshalledSnapshot, err := json.Marshal(snapshot)
+	if err != nil {
+		logging.Error.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), defaultStatePermissions); err != nil {
+		return err
+	}
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(s.path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tempFile.Write(marshalledSnapshot); err != nil {
+		return err
+	}
+
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), s.path)
+}
+
+func (c *ZoteroClient) downloadSnapshot(ctx context.Context, collectionKeys []ZoteroKey, filter ZoteroFilter) (zoteroLibrarySnapshot, error) {
+	citeResponseList, libraryVersion, err := c.downloadCiteResponses(ctx, collectionKeys, filter, nil)
+	if err != nil {
+		return zoteroLibrarySnapshot{}, err
+	}
+
+	attachmentResponseList, err := c.downloadAttachmentResponses(ctx, collectionKeys, nil)
+	if err != nil {
+		return zoteroLibrarySnapshot{}, err
+	}
+
+	return zoteroLibrarySnapshot{
+		Version:     libraryVersion,
+		Citations:   citeResponseList,
+		Attachments: attachmentResponseList,
+	}, nil
+}
+
+func (c *ZoteroClient) downloadDeletedKeys(ctx context.Context, since ZoteroVersion) (map[ZoteroKey]struct{}, error) {
+	apiResponse, err := c.httpClient.RequestWithHeaders(ctx, http.MethodGet, c.library.apiUrl("deleted", url.Values{"since": {strconv.Itoa(int(since))}}), c.headers)
+	if err != nil {
+		return nil, err
+	}
+
+	var deletedResponse zoteroDeletedResponse
+
+	if err := network.UnmarshalJson(apiResponse, &deletedResponse); err != nil {
+		return nil, err
+	}
+
+	deletedKeys := make(map[ZoteroKey]struct{}, len(deletedResponse.Items))
+	for _, key := range deletedResponse.Items {
+		deletedKeys[key] = struct{}{}
+	}
+
+	return deletedKeys, nil
+}
+
+// downloadCurrentKeys returns the keys of every item which currently matches
+// the filter. Items which are moved to the trash, removed from a collection or
+// no longer have a tag don't show up as deleted, so this is how we find them.
+// This is a single request, because the API doesn't paginate `versions`.
+func (c *ZoteroClient) downloadCurrentKeys(ctx context.Context, collectionKeys []ZoteroKey, filter ZoteroFilter) (map[ZoteroKey]struct{}, error) {
+	currentKeys := make(map[ZoteroKey]struct{})
+
+	query := filter.query()
+	query.Set("format", "versions")
+
+	for _, path := range itemPaths(collectionKeys) {
+		apiResponse, err := c.httpClient.RequestWithHeaders(ctx, http.MethodGet, c.library.apiUrl(path, query), c.headers)
+		if err != nil {
+			return nil, err
+		}
+
+		var versionsResponse map[ZoteroKey]ZoteroVersion
+
+		if err := network.UnmarshalJson(apiResponse, &versionsResponse); err != nil {
+			return nil, err
+		}
+
+		for key := range versionsResponse {
+			currentKeys[key] = struct{}{}
+		}
+	}
+
+	return currentKeys, nil
+}
+
+// updateSnapshot downloads the items and attachments which have changed since
+// the previous snapshot, and removes the ones which have been deleted.
+// Updated items keep their position, and new items are added to the end.
+func (c *ZoteroClient) updateSnapshot(ctx context.Context, collectionKeys []ZoteroKey, filter ZoteroFilter, previous zoteroLibrarySnapshot) (zoteroLibrarySnapshot, error) {
+	changedCitations, libraryVersion, err := c.downloadCiteResponses(ctx, collectionKeys, filter, &previous.Version)
+	if err != nil {
+		return zoteroLibrarySnapshot{}, err
+	}
+
+	changedAttachments, err := c.downloadAttachmentResponses(ctx, collectionKeys, &previous.Version)
+	if err != nil {
+		return zoteroLibrarySnapshot{}, err
+	}
+
+	deletedKeys, err := c.downloadDeletedKeys(ctx, previous.Version)
+	if err != nil {
+		return zoteroLibrarySnapshot{}, err
+	}
+
+	currentKeys, err := c.downloadCurrentKeys(ctx, collectionKeys, filter)
+	if err != nil {
+		return zoteroLibrarySnapshot{}, err
+	}
+
+	// If the API didn't return a version, we sync from the same version next
+	// time, which may download some items twice but never misses any.
+	if libraryVersion == 0 {
+		libraryVersion = previous.Version
+	}
+
+	logging.Verbose.Printf("Synced Zotero library from version %d to %d: %d changed items, %d changed attachments, %d deleted", previous.Version, libraryVersion, len(changedCitations), len(changedAttachments), len(deletedKeys))
+
+	changedCitationMap := make(map[ZoteroKey]zoteroCitationResponse, len(changedCitations))
+	for _, citeResponse := range changedCitations {
+		changedCitationMap[citeResponse.Key] = citeResponse
+	}
+
+	citations := make([]zoteroCitationResponse, 0, len(previous.Citations)+len(changedCitations))
+
+	for _, citeResponse := range previous.Citations {
+		if _, isCurrent := currentKeys[citeResponse.Key]; !isCurrent {
+			continue
+		}
+
+		if changedResponse, isChanged := changedCitationMap[citeResponse.Key]; isChanged {
+			citeResponse = changedResponse
+			delete(changedCitationMap, citeResponse.Key)
+		}
+
+		citations = append(citations, citeResponse)
+	}
+
+	for _, citeResponse := range changedCitations {
+		if _, isNew := changedCitationMap[citeResponse.Key]; isNew {
+			citations = append(citations, citeResponse)
+		}
+	}
+
+	changedAttachmentMap := make(map[ZoteroKey]zoteroAttachmentResponse, len(changedAttachments))
+	for _, attachmentResponse := range changedAttachments {
+		changedAttachmentMap[attachmentResponse.Key] = attachmentResponse
+	}
+
+	attachments := make([]zoteroAttachmentResponse, 0, len(previous.Attachments)+len(changedAttachments))
+
+	for _, attachmentResponse := range previous.Attachments {
+		if _, isDeleted := deletedKeys[attachmentResponse.Key]; isDeleted {
+			continue
+		}
+
+		if changedResponse, isChanged := changedAttachmentMap[attachmentResponse.Key]; isChanged {
+			attachmentResponse = changedResponse
+			delete(changedAttachmentMap, attachmentResponse.Key)
+		}
+
+		attachments = append(attachments, attachmentResponse)
+	}
+
+	for _, attachmentResponse := range changedAttachments {
+		if _, isNew := changedAttachmentMap[attachmentResponse.Key]; isNew {
+			attachments = append(attachments, attachmentResponse)
+		}
+	}
+
+	return zoteroLibrarySnapshot{
+		Version:     libraryVersion,
+		Citations:   citations,
+		Attachments: attachments,
+	}, nil
+}
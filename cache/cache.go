@@ -0,0 +1,387 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/frawleyskid/ipfs-bib/config"
+	"github.com/frawleyskid/ipfs-bib/logging"
+	"github.com/frawleyskid/ipfs-bib/spool"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cacheDirName         = "ipfs-bib"
+	metadataFileSuffix   = ".json"
+	bodyFileSuffix       = ".body"
+	cacheDirPermissions  = 0755
+	cacheFilePermissions = 0644
+)
+
+var ErrCache = errors.New("download cache error")
+
+type Key struct {
+	Url url.URL
+	Doi *string
+}
+
+func (k Key) hash() string {
+	var keyBuilder strings.Builder
+
+	keyBuilder.WriteString(k.Url.String())
+
+	if k.Doi != nil {
+		keyBuilder.WriteString("\n")
+		keyBuilder.WriteString(*k.Doi)
+	}
+
+	hash := sha256.Sum256([]byte(keyBuilder.String()))
+
+	return hex.EncodeToString(hash[:])
+}
+
+type Entry struct {
+	Url       url.URL
+	Header    http.Header
+	MediaType string
+	Body      *spool.File
+}
+
+type entryMetadata struct {
+	Url       string      `json:"url"`
+	Header    http.Header `json:"header"`
+	MediaType string      `json:"mediaType"`
+	StoredAt  time.Time   `json:"storedAt"`
+}
+
+type indexEntry struct {
+	size       int64
+	lastAccess time.Time
+}
+
+// Cache is an on-disk cache of downloaded sources. Entries expire after a TTL,
+// and the least recently used entries are evicted once the cache grows past
+// its maximum size. Cached bodies are copied into the spool when they're read,
+// so they can't be evicted while they're in use. A nil *Cache is valid and
+// caches nothing.
+type Cache struct {
+	dir         string
+	ttl         time.Duration
+	maxSize     int64
+	refresh     bool
+	sourceSpool *spool.Spool
+	index       map[string]indexEntry
+	totalSize   int64
+	lock        sync.Mutex
+}
+
+func Open(dir string, ttl time.Duration, maxSize int64, refresh bool, sourceSpool *spool.Spool) (*Cache, error) {
+	if err := os.MkdirAll(dir, cacheDirPermissions); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCache, err)
+	}
+
+	cache := &Cache{
+		dir:         dir,
+		ttl:         ttl,
+		maxSize:     maxSize,
+		refresh:     refresh,
+		sourceSpool: sourceSpool,
+		index:       make(map[string]indexEntry),
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCache, err)
+	}
+
+	bodySizes := make(map[string]int64)
+
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), bodyFileSuffix) {
+			bodySizes[strings.TrimSuffix(file.Name(), bodyFileSuffix)] = file.Size()
+		}
+	}
+
+	// We use the modification time of the metadata file to track when each
+	// entry was last accessed.
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), metadataFileSuffix) {
+			continue
+		}
+
+		keyHash := strings.TrimSuffix(file.Name(), metadataFileSuffix)
+
+		bodySize, ok := bodySizes[keyHash]
+		if !ok {
+			continue
+		}
+
+		cache.index[keyHash] = indexEntry{size: bodySize, lastAccess: file.ModTime()}
+		cache.totalSize += bodySize
+	}
+
+	return cache, nil
+}
+
+func FromConfig(cfg config.Config, sourceSpool *spool.Spool) (*Cache, error) {
+	if !cfg.File.Cache.Enabled || cfg.Flags.NoCache {
+		return nil, nil //nolint:nilnil
+	}
+
+	cacheDir := cfg.File.Cache.Path
+
+	if cacheDir == "" {
+		userCacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCache, err)
+		}
+
+		cacheDir = filepath.Join(userCacheDir, cacheDirName)
+	}
+
+	return Open(cacheDir, cfg.File.Cache.Ttl, cfg.File.Cache.MaxSize, cfg.Flags.Refresh, sourceSpool)
+}
+
+func (c *Cache) metadataPath(keyHash string) string {
+	return filepath.Join(c.dir, keyHash+metadataFileSuffix)
+}
+
+func (c *Cache) bodyPath(keyHash string) string {
+	return filepath.Join(c.dir, keyHash+bodyFileSuffix)
+}
+
+func (c *Cache) Get(key Key) (Entry, bool) {
+	if c == nil || c.refresh {
+		return Entry{}, false
+	}
+
+	keyHash := key.hash()
+
+	c.lock.Lock()
+	_, ok := c.index[keyHash]
+	c.lock.Unlock()
+
+	if !ok {
+		return Entry{}, false
+	}
+
+	// Copying the body into the spool can take a while, so we don't hold the
+	// lock while we do it. Files in the cache are replaced atomically, and a
+	// body which is evicted while it's open can still be read.
+	entry, storedAt, err := c.read(keyHash)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err != nil {
+		logging.Verbose.Println(err)
+		c.remove(keyHash)
+
+		return Entry{}, false
+	}
+
+	now := time.Now()
+
+	if c.ttl > 0 && now.Sub(storedAt) > c.ttl {
+		entry.Body.Remove()
+		c.remove(keyHash)
+
+		return Entry{}, false
+	}
+
+	if err := os.Chtimes(c.metadataPath(keyHash), now, now); err != nil {
+		logging.Verbose.Println(fmt.Errorf("%w: %v", ErrCache, err))
+	}
+
+	// The entry may have been evicted while we were reading it.
+	if indexed, ok := c.index[keyHash]; ok {
+		c.index[keyHash] = indexEntry{size: indexed.size, lastAccess: now}
+	}
+
+	return entry, true
+}
+
+func (c *Cache) read(keyHash string) (Entry, time.Time, error) {
+	rawMetadata, err := os.ReadFile(c.metadataPath(keyHash))
+	if err != nil {
+		return Entry{}, time.Time{}, fmt.Errorf("%w: %v", ErrCache, err)
+	}
+
+	var metadata entryMetadata
+
+	if err := json.Unmarshal(rawMetadata, &metadata); err != nil {
+		return Entry{}, time.Time{}, fmt.Errorf("%w: %v", ErrCache, err)
+	}
+
+	entryUrl, err := url.Parse(metadata.Url)
+	if err != nil {
+		return Entry{}, time.Time{}, fmt.Errorf("%w: %v", ErrCache, err)
+	}
+
+	bodyFile, err := os.Open(c.bodyPath(keyHash))
+	if err != nil {
+		return Entry{}, time.Time{}, fmt.Errorf("%w: %v", ErrCache, err)
+	}
+
+	body, err := c.sourceSpool.Write(bodyFile, metadata.MediaType)
+
+	if closeErr := bodyFile.Close(); closeErr != nil {
+		logging.Verbose.Println(fmt.Errorf("%w: %v", ErrCache, closeErr))
+	}
+
+	if err != nil {
+		return Entry{}, time.Time{}, fmt.Errorf("%w: %v", ErrCache, err)
+	}
+
+	return Entry{
+		Url:       *entryUrl,
+		Header:    metadata.Header,
+		MediaType: metadata.MediaType,
+		Body:      body,
+	}, metadata.StoredAt, nil
+}
+
+func (c *Cache) Put(key Key, entry Entry) {
+	if c == nil {
+		return
+	}
+
+	if err := c.put(key, entry); err != nil {
+		logging.Verbose.Println(err)
+	}
+}
+
+func (c *Cache) put(key Key, entry Entry) error {
+	entrySize := entry.Body.Size()
+	if c.maxSize > 0 && entrySize > c.maxSize {
+		return nil
+	}
+
+	keyHash := key.hash()
+
+	marshalledMetadata, err := json.Marshal(entryMetadata{
+		Url:       entry.Url.String(),
+		Header:    entry.Header,
+		MediaType: entry.MediaType,
+		StoredAt:  time.Now().UTC(),
+	})
+	if err != nil {
+		logging.Error.Fatal(err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	body, err := entry.Body.Open()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCache, err)
+	}
+
+	defer func() {
+		if err := body.Close(); err != nil {
+			logging.Verbose.Println(fmt.Errorf("%w: %v", ErrCache, err))
+		}
+	}()
+
+	// We write the body before the metadata, because an entry is only
+	// considered complete once its metadata exists.
+	if err := writeFileAtomic(c.bodyPath(keyHash), body); err != nil {
+		return fmt.Errorf("%w: %v", ErrCache, err)
+	}
+
+	if err := writeFileAtomic(c.metadataPath(keyHash), bytes.NewReader(marshalledMetadata)); err != nil {
+		return fmt.Errorf("%w: %v", ErrCache, err)
+	}
+
+	if existing, ok := c.index[keyHash]; ok {
+		c.totalSize -= existing.size
+	}
+
+	c.index[keyHash] = indexEntry{size: entrySize, lastAccess: time.Now()}
+	c.totalSize += entrySize
+
+	c.evict()
+
+	return nil
+}
+
+func (c *Cache) remove(keyHash string) {
+	for _, filePath := range []string{c.metadataPath(keyHash), c.bodyPath(keyHash)} {
+		if err := os.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logging.Verbose.Println(fmt.Errorf("%w: %v", ErrCache, err))
+		}
+	}
+
+	if existing, ok := c.index[keyHash]; ok {
+		c.totalSize -= existing.size
+		delete(c.index, keyHash)
+	}
+}
+
+func (c *Cache) evict() {
+	if c.maxSize <= 0 || c.totalSize <= c.maxSize {
+		return
+	}
+
+	keyHashes := make([]string, 0, len(c.index))
+	for keyHash := range c.index {
+		keyHashes = append(keyHashes, keyHash)
+	}
+
+	sort.Slice(keyHashes, func(i, j int) bool {
+		return c.index[keyHashes[i]].lastAccess.Before(c.index[keyHashes[j]].lastAccess)
+	})
+
+	for _, keyHash := range keyHashes {
+		if c.totalSize <= c.maxSize {
+			break
+		}
+
+		c.remove(keyHash)
+	}
+}
+
+func writeFileAtomic(filePath string, content io.Reader) error {
+	tempFile, err := ioutil.TempFile(filepath.Dir(filePath), ".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tempFile, content)
+
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Chmod(tempFile.Name(), cacheFilePermissions)
+	}
+
+	if err == nil {
+		err = os.Rename(tempFile.Name(), filePath)
+	}
+
+	// The temporary file would otherwise be left in the cache directory, where
+	// it's never evicted.
+	if err != nil {
+		if removeErr := os.Remove(tempFile.Name()); removeErr != nil {
+			logging.Verbose.Println(fmt.Errorf("%w: %v", ErrCache, removeErr))
+		}
+
+		return err
+	}
+
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/frawleyskid/ipfs-bib/archive"
 	"github.com/frawleyskid/ipfs-bib/config"
 	"github.com/frawleyskid/ipfs-bib/logging"
+	"github.com/frawleyskid/ipfs-bib/spool"
 	"github.com/frawleyskid/ipfs-bib/store"
 	"io/ioutil"
 	"os"
@@ -14,10 +15,10 @@ import (
 
 var (
 	rootCmd = &cobra.Command{
-		Use:                   "ipfs-bib [options] <bibtex_file>",
+		Use:                   "ipfs-bib [options] <input_file>",
 		Short:                 "A tool for hosting bibliographic references on IPFS",
-		Long:                  "A tool for hosting bibliographic references on IPFS.\n\nThis command accepts the path of a bibtex/biblatex file, or `-` to read from stdin.\nIf --zotero is passed, this accepts a Zotero group ID instead.",
-		Args:                  cobra.ExactArgs(1),
+		Long:                  "A tool for hosting bibliographic references on IPFS.\n\nThis command accepts the path of a bibtex/biblatex, RIS or CSL-JSON file, or `-` to read from stdin.\nIf --zotero is passed, this accepts a Zotero library instead, either `user:<id>` or `group:<id>`.\nIf --zotero-local is passed, this optionally accepts a Zotero group library, `group:<id>`. Otherwise, use the user library.",
+		Args:                  inputArgs,
 		Version:               "0.1.0",
 		DisableFlagsInUseLine: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -36,30 +37,85 @@ var (
 				logging.Verbose.SetOutput(ioutil.Discard)
 			}
 
-			bibChan, contentsChan := archive.Load(ctx, cfg, args[0])
+			var journal *archive.Journal
+
+			if stateDir := cfg.Flags.MaybeStateDir(); stateDir != nil {
+				journal, err = archive.OpenJournal(*stateDir)
+				if err != nil {
+					return err
+				}
+			}
 
 			sourceStore, err := store.SourceStoreFromConfig(ctx, cfg)
 			if err != nil {
 				return err
 			}
 
-			location, metadata, err := archive.Store(ctx, cfg, contentsChan, sourceStore)
+			sourceSpool, err := spool.FromConfig(cfg)
+			if err != nil {
+				return err
+			}
+
+			defer func() {
+				if err := sourceSpool.Close(); err != nil {
+					logging.Verbose.Println(err)
+				}
+			}()
+
+			var input string
+			if len(args) > 0 {
+				input = args[0]
+			}
+
+			budget := archive.NewBudget(cfg)
+
+			bibChan, contentsChan := archive.Load(ctx, cfg, input, journal, sourceStore, sourceSpool, budget)
+
+			location, metadata, err := archive.Store(ctx, cfg, contentsChan, sourceStore, journal, budget)
 			if err != nil {
 				return err
 			}
 
+			if err := journal.Close(); err != nil {
+				return err
+			}
+
 			if cfg.Flags.MaybeOutputPath() != nil {
 				bibResult := <-bibChan
 				if bibResult.Error != nil {
 					return bibResult.Error
 				}
 
-				if err := archive.UpdateBib(bibResult.Bib, cfg.File.Ipfs.MaybeGateway(), location); err != nil {
+				outputFormat, err := archive.OutputFormat(cfg)
+				if err != nil {
 					return err
 				}
 
-				if err := archive.WriteBib(bibResult.Bib, cfg.Flags.OutputPath); err != nil {
-					return err
+				switch outputFormat {
+				case archive.FormatCslJson:
+					csl := bibResult.Csl
+					if csl == nil {
+						bibCsl := archive.BibtexToCsl(bibResult.Bib)
+						csl = &bibCsl
+					} else if cfg.File.Crossref.Enrich {
+						archive.EnrichCsl(*csl, bibResult.Bib)
+					}
+
+					if err := archive.UpdateCsl(*csl, cfg.File.Ipfs.MaybeGateway(), location); err != nil {
+						return err
+					}
+
+					if err := archive.WriteCsl(*csl, cfg.Flags.OutputPath); err != nil {
+						return err
+					}
+				default:
+					if err := archive.UpdateBib(bibResult.Bib, cfg.File.Ipfs.MaybeGateway(), location); err != nil {
+						return err
+					}
+
+					if err := archive.WriteBib(bibResult.Bib, cfg.Flags.OutputPath); err != nil {
+						return err
+					}
 				}
 			}
 
@@ -79,6 +135,16 @@ var (
 	}
 )
 
+// inputArgs requires an input file or Zotero library, except when reading
+// from a local Zotero data directory, where the user library is the default.
+func inputArgs(cmd *cobra.Command, args []string) error {
+	if zoteroLocal, _ := cmd.Flags().GetString("zotero-local"); zoteroLocal != "" {
+		return cobra.MaximumNArgs(1)(cmd, args)
+	}
+
+	return cobra.ExactArgs(1)(cmd, args)
+}
+
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
@@ -88,13 +154,26 @@ func Execute() {
 func init() {
 	rootCmd.SetVersionTemplate("ipfs-bib {{ .Version }}\n")
 	rootCmd.Flags().StringP("config", "c", "", "The `path` of the config file to use. Otherwise, use the default config.")
-	rootCmd.Flags().StringP("output", "o", "", "Generate a new bibtex file at this `path` with the IPFS URLs added to each entry.")
+	rootCmd.Flags().StringP("output", "o", "", "Generate a new bibtex or CSL-JSON file at this `path` with the IPFS URLs added to each entry.")
+	rootCmd.Flags().String("output-format", "", "The `format` of the output file, either \"bibtex\" or \"csl-json\". Otherwise, detect it from the file extension.")
 	rootCmd.Flags().String("car", "", "Rather than add the sources to an IPFS node, export them as a CAR archive at this `path`.")
 	rootCmd.Flags().Bool("pin", false, "Pin the source files when adding them to the IPFS node.")
 	rootCmd.Flags().String("pin-remote", "", "Pin the source files using each of the configured IPFS pinning services. Pass a `name` for the pin.")
 	rootCmd.Flags().Bool("json", false, "Produce machine-readable JSON output.")
-	rootCmd.Flags().Bool("zotero", false, "Pull references from a public Zotero library. Pass a Zotero group ID.")
+	rootCmd.Flags().String("format", "", "The `format` of the input file, either \"bibtex\", \"ris\" or \"csl-json\". Otherwise, detect it from the file extension or contents.")
+	rootCmd.Flags().Bool("zotero", false, "Pull references from a Zotero library. Pass user:<id> for a user library or group:<id> for a group library.")
+	rootCmd.Flags().String("zotero-local", "", "Pull references and attachments from the local Zotero data directory at this `path` instead of the Zotero API. Zotero doesn't need to be running.")
+	rootCmd.Flags().String("zotero-collection", "", "Only pull references from the Zotero collection with this `key`.")
+	rootCmd.Flags().Bool("zotero-recursive", false, "When passed with --zotero-collection, also pull references from its subcollections.")
+	rootCmd.Flags().StringSlice("zotero-tag", nil, "Only pull references from Zotero which have this `tag`. This can be passed more than once to require multiple tags.")
+	rootCmd.Flags().String("zotero-item-type", "", "Only pull references from Zotero with this item `type` (e.g. journalArticle). This accepts the same syntax as the Zotero API, like \"book || bookSection\" or \"-note\".")
 	rootCmd.Flags().BoolP("verbose", "v", false, "Print verbose output.")
 	rootCmd.Flags().Bool("dry-run", false, "Download sources, but don't add them to IPFS or export them as a CAR.")
+	rootCmd.Flags().IntP("jobs", "j", 0, "The `number` of sources to download concurrently. Otherwise, use the value in the config file.")
+	rootCmd.Flags().String("state-dir", "", "Keep a journal of each entry in the directory at this `path` so that an interrupted run can be resumed.")
+	rootCmd.Flags().Bool("no-cache", false, "Don't read sources from or write sources to the download cache.")
+	rootCmd.Flags().Bool("refresh", false, "Download every source again and update the download cache.")
+	rootCmd.Flags().String("update-from", "", "Update a previous archive rather than starting from scratch. Pass the root `cid` of the previous archive, or the path of a CAR archive.")
+	rootCmd.Flags().Bool("prune", false, "When passed with --update-from, remove sources for entries which no longer exist or whose license is no longer allowed.")
 	rootCmd.Flags().String("mfs", "", "Add the sources to MFS at this `path`.")
 }
@@ -7,23 +7,49 @@ import (
 	"github.com/frawleyskid/ipfs-bib/network"
 	"github.com/ipfs/go-cid"
 	"github.com/nickng/bibtex"
+	"io"
 	"mime"
 	"net/http"
 	"net/url"
 	"path"
 	"regexp"
+	"strings"
+	"time"
 )
 
 const (
-	canonicalDoiUrlPrefix = "https://doi.org/"
+	canonicalDoiUrlPrefix    = "https://doi.org/"
+	canonicalArxivUrlPrefix  = "https://arxiv.org/abs/"
+	canonicalPmcUrlPrefix    = "https://www.ncbi.nlm.nih.gov/pmc/articles/"
+	canonicalPubmedUrlPrefix = "https://pubmed.ncbi.nlm.nih.gov/"
 )
 
 const doiRegexMatchGroup = 4
 
 var doiRegex = regexp.MustCompile(`^(doi:|(https?://)?(dx\.)?doi\.org/)?(10\.[0-9]{4,}(\.[0-9]+)*/\S+)$`)
 
+// This matches both new-style (e.g. `2101.00001v2`) and old-style (e.g.
+// `hep-th/9901001`) arXiv identifiers, with an optional version.
+const arxivIdPattern = `(\d{4}\.\d{4,5}|[a-z\-]+(\.[A-Z]{2})?/\d{7})(v\d+)?`
+
+var (
+	arxivIdRegex  = regexp.MustCompile(`^(arXiv:)?` + arxivIdPattern + `$`)
+	arxivUrlRegex = regexp.MustCompile(`^https?://(?:www\.|export\.)?arxiv\.org/(?:abs|pdf)/` + arxivIdPattern + `(?:\.pdf)?/?$`)
+	arxivDoiRegex = regexp.MustCompile(`(?i)^10\.48550/arxiv\.` + arxivIdPattern + `$`)
+)
+
+var (
+	pmidRegex      = regexp.MustCompile(`^(?i:pmid:?\s*)?(\d+)$`)
+	pmcidRegex     = regexp.MustCompile(`^(?i:pmcid:?\s*)?(?i:pmc)?(\d+)$`)
+	pubmedUrlRegex = regexp.MustCompile(`^https?://(?:pubmed\.ncbi\.nlm\.nih\.gov|(?:www\.)?ncbi\.nlm\.nih\.gov/pubmed)/(\d+)/?$`)
+	pmcUrlRegex    = regexp.MustCompile(`^https?://(?:(?:www\.)?ncbi\.nlm\.nih\.gov/pmc|pmc\.ncbi\.nlm\.nih\.gov|(?:www\.)?europepmc\.org)/articles/(?i:pmc)(\d+)(?:/.*)?$`)
+)
+
+// These are the fields which name the archive an `eprint` field belongs to.
+var eprintArchiveFields = []string{"archiveprefix", "eprinttype"}
+
 var (
-	ErrCouldNotLocateEntry = errors.New("bibtex entry has no URL or DOI")
+	ErrCouldNotLocateEntry = errors.New("bibtex entry has no URL, DOI or other identifier")
 	ErrMalformedGateway    = errors.New("IPFS gateway is malformed")
 )
 
@@ -71,8 +97,53 @@ func InferFileName(sourceUrl *url.URL, mediaType string, header http.Header) str
 }
 
 type SourceLocator struct {
-	Url url.URL
-	Doi *string
+	Url     url.URL
+	Doi     *string
+	ArxivId *string
+	Pmid    *string
+	Pmcid   *string
+	UrlDate *time.Time
+
+	// The license in the entry itself, which applies to any source found for
+	// it unless a more specific license is known.
+	License *string
+}
+
+// ArxivId is an arXiv identifier, optionally pinned to a version.
+type ArxivId struct {
+	Id      string
+	Version *string
+}
+
+func (a ArxivId) String() string {
+	if a.Version == nil {
+		return a.Id
+	}
+
+	return a.Id + *a.Version
+}
+
+func ParseArxivId(rawId string) (ArxivId, bool) {
+	var matches []string
+
+	for _, regex := range []*regexp.Regexp{arxivIdRegex, arxivUrlRegex, arxivDoiRegex} {
+		if matches = regex.FindStringSubmatch(rawId); matches != nil {
+			break
+		}
+	}
+
+	if matches == nil {
+		return ArxivId{}, false
+	}
+
+	// The identifier and version are always the last groups in the match.
+	arxivId := ArxivId{Id: matches[len(matches)-3]}
+
+	if version := matches[len(matches)-1]; version != "" {
+		arxivId.Version = &version
+	}
+
+	return arxivId, true
 }
 
 func BibEntryField(entry bibtex.BibEntry, field string) *string {
@@ -84,6 +155,120 @@ func BibEntryField(entry bibtex.BibEntry, field string) *string {
 	return nil
 }
 
+// bibEntryFieldFold is like BibEntryField, but ignores the case of the field
+// name, because fields like `archivePrefix` are often written in camel case.
+func bibEntryFieldFold(entry bibtex.BibEntry, field string) *string {
+	for name, value := range entry.Fields {
+		if strings.EqualFold(name, field) {
+			stringValue := value.String()
+			return &stringValue
+		}
+	}
+
+	return nil
+}
+
+// locateArxivId finds the arXiv identifier of an entry from its `eprint`
+// field, its URL or its DOI.
+func locateArxivId(entry bibtex.BibEntry, sourceUrl *url.URL, sourceDoi *string) *string {
+	if eprint := bibEntryFieldFold(entry, "eprint"); eprint != nil {
+		isArxiv := strings.HasPrefix(*eprint, "arXiv:")
+
+		for _, archiveField := range eprintArchiveFields {
+			if archive := bibEntryFieldFold(entry, archiveField); archive != nil && strings.EqualFold(*archive, "arxiv") {
+				isArxiv = true
+			}
+		}
+
+		if arxivId, ok := ParseArxivId(*eprint); ok && isArxiv {
+			id := arxivId.String()
+			return &id
+		}
+	}
+
+	for _, candidate := range []*string{sourceDoi, urlString(sourceUrl)} {
+		if candidate == nil {
+			continue
+		}
+
+		if arxivId, ok := ParseArxivId(*candidate); ok {
+			id := arxivId.String()
+			return &id
+		}
+	}
+
+	return nil
+}
+
+// locatePubmedIds finds the PubMed ID and PubMed Central ID of an entry from
+// its `pmid` and `pmcid` fields or its URL. PMCIDs always have the `PMC`
+// prefix.
+func locatePubmedIds(entry bibtex.BibEntry, sourceUrl *url.URL) (pmid *string, pmcid *string) {
+	if rawPmid := bibEntryFieldFold(entry, "pmid"); rawPmid != nil {
+		if matches := pmidRegex.FindStringSubmatch(strings.TrimSpace(*rawPmid)); matches != nil {
+			pmid = &matches[1]
+		}
+	}
+
+	if rawPmcid := bibEntryFieldFold(entry, "pmcid"); rawPmcid != nil {
+		if matches := pmcidRegex.FindStringSubmatch(strings.TrimSpace(*rawPmcid)); matches != nil {
+			prefixedPmcid := "PMC" + matches[1]
+			pmcid = &prefixedPmcid
+		}
+	}
+
+	if rawUrl := urlString(sourceUrl); rawUrl != nil {
+		if matches := pubmedUrlRegex.FindStringSubmatch(*rawUrl); matches != nil && pmid == nil {
+			pmid = &matches[1]
+		}
+
+		if matches := pmcUrlRegex.FindStringSubmatch(*rawUrl); matches != nil && pmcid == nil {
+			prefixedPmcid := "PMC" + matches[1]
+			pmcid = &prefixedPmcid
+		}
+	}
+
+	return pmid, pmcid
+}
+
+// These are the formats of `urldate` fields we accept, from most to least
+// precise.
+var urlDateLayouts = []string{"2006-01-02", "2006-01", "2006"}
+
+// locateUrlDate parses the date the URL of an entry was accessed.
+func locateUrlDate(entry bibtex.BibEntry) *time.Time {
+	rawUrlDate := BibEntryField(entry, "urldate")
+	if rawUrlDate == nil {
+		return nil
+	}
+
+	// Dates exported from Zotero may include the time after a space.
+	dateFields := strings.Fields(*rawUrlDate)
+	if len(dateFields) == 0 {
+		return nil
+	}
+
+	for _, layout := range urlDateLayouts {
+		if urlDate, err := time.Parse(layout, dateFields[0]); err == nil {
+			return &urlDate
+		}
+	}
+
+	logging.Verbose.Printf("malformed bibtex urldate: %s", *rawUrlDate)
+
+	return nil
+}
+
+func urlString(sourceUrl *url.URL) *string {
+	if sourceUrl == nil {
+		return nil
+	}
+
+	rawUrl := sourceUrl.String()
+
+	return &rawUrl
+}
+
 func LocateEntry(entry bibtex.BibEntry) (SourceLocator, error) {
 	var (
 		sourceUrl *url.URL
@@ -112,6 +297,9 @@ func LocateEntry(entry bibtex.BibEntry) (SourceLocator, error) {
 		}
 	}
 
+	sourceArxivId := locateArxivId(entry, sourceUrl, sourceDoi)
+	sourcePmid, sourcePmcid := locatePubmedIds(entry, sourceUrl)
+
 	if sourceUrl == nil && sourceDoi != nil {
 		sourceUrl, err = url.Parse(canonicalDoiUrlPrefix + url.PathEscape(*sourceDoi))
 		if err != nil {
@@ -119,27 +307,60 @@ func LocateEntry(entry bibtex.BibEntry) (SourceLocator, error) {
 		}
 	}
 
+	if sourceUrl == nil && sourceArxivId != nil {
+		sourceUrl, err = url.Parse(canonicalArxivUrlPrefix + *sourceArxivId)
+		if err != nil {
+			logging.Error.Fatal(err)
+		}
+	}
+
+	if sourceUrl == nil && sourcePmcid != nil {
+		sourceUrl, err = url.Parse(canonicalPmcUrlPrefix + *sourcePmcid + "/")
+		if err != nil {
+			logging.Error.Fatal(err)
+		}
+	}
+
+	if sourceUrl == nil && sourcePmid != nil {
+		sourceUrl, err = url.Parse(canonicalPubmedUrlPrefix + *sourcePmid + "/")
+		if err != nil {
+			logging.Error.Fatal(err)
+		}
+	}
+
 	if sourceUrl == nil {
 		return SourceLocator{}, fmt.Errorf("%w: %s", ErrCouldNotLocateEntry, entry.CiteName)
 	} else {
-		return SourceLocator{Url: *sourceUrl, Doi: sourceDoi}, nil
+		return SourceLocator{
+			Url:     *sourceUrl,
+			Doi:     sourceDoi,
+			ArxivId: sourceArxivId,
+			Pmid:    sourcePmid,
+			Pmcid:   sourcePmcid,
+			UrlDate: locateUrlDate(entry),
+			License: EntryLicense(entry),
+		}, nil
 	}
 }
 
+type BibSourceFile struct {
+	Content  io.Reader
+	FileName string
+}
+
+// BibSource is the content to archive for an entry. The first file is the
+// main source, and any others are archived alongside it in the same directory.
 type BibSource struct {
-	Content       []byte
+	Files         []BibSourceFile
 	DirectoryName string
-	FileName      string
 }
 
-type BibEntryLocation struct {
-	FileCid       cid.Cid
-	FileName      string
-	DirectoryCid  cid.Cid
-	DirectoryName string
+type BibFileLocation struct {
+	FileCid  cid.Cid
+	FileName string
 }
 
-func (l *BibEntryLocation) IpfsUrl() url.URL {
+func (l BibFileLocation) IpfsUrl() url.URL {
 	ipfsUrl, err := url.Parse(fmt.Sprintf("ipfs://%s/?filename=%s", l.FileCid.String(), url.QueryEscape(l.FileName)))
 	if err != nil {
 		logging.Error.Fatal(err)
@@ -148,7 +369,7 @@ func (l *BibEntryLocation) IpfsUrl() url.URL {
 	return *ipfsUrl
 }
 
-func (l *BibEntryLocation) GatewayUrl(gateway string) (url.URL, error) {
+func (l BibFileLocation) GatewayUrl(gateway string) (url.URL, error) {
 	gatewayUrl, err := url.Parse(fmt.Sprintf("https://%s/ipfs/%s/?filename=%s", gateway, l.FileCid.String(), url.QueryEscape(l.FileName)))
 	if err != nil {
 		return url.URL{}, fmt.Errorf("%w: %s", ErrMalformedGateway, gateway)
@@ -156,3 +377,26 @@ func (l *BibEntryLocation) GatewayUrl(gateway string) (url.URL, error) {
 
 	return *gatewayUrl, nil
 }
+
+// BibEntryLocation is where an entry is stored. FileCid and FileName are the
+// main source, and Files lists every file in the directory, including the main
+// source.
+type BibEntryLocation struct {
+	FileCid       cid.Cid
+	FileName      string
+	DirectoryCid  cid.Cid
+	DirectoryName string
+	Files         []BibFileLocation
+}
+
+func (l *BibEntryLocation) mainFile() BibFileLocation {
+	return BibFileLocation{FileCid: l.FileCid, FileName: l.FileName}
+}
+
+func (l *BibEntryLocation) IpfsUrl() url.URL {
+	return l.mainFile().IpfsUrl()
+}
+
+func (l *BibEntryLocation) GatewayUrl(gateway string) (url.URL, error) {
+	return l.mainFile().GatewayUrl(gateway)
+}
@@ -0,0 +1,147 @@
+package config
+
+import (
+	"github.com/nickng/bibtex"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	creativeCommonsHostname = "creativecommons.org"
+	publicDomainLicense     = "public-domain"
+)
+
+// These are the words in the full names of Creative Commons licenses (e.g.
+// "Creative Commons Attribution-NonCommercial 4.0 International") and the
+// license elements they stand for.
+var creativeCommonsElements = map[string]string{
+	"attribution":   "by",
+	"noncommercial": "nc",
+	"noderivatives": "nd",
+	"noderivs":      "nd",
+	"sharealike":    "sa",
+	"zero":          "0",
+	"by":            "by",
+	"nc":            "nc",
+	"nd":            "nd",
+	"sa":            "sa",
+	"cc":            "",
+	"commons":       "",
+	"creative":      "",
+	"international": "",
+	"license":       "",
+	"licence":       "",
+	"unported":      "",
+	"universal":     "",
+	"generic":       "",
+	"public":        "",
+	"domain":        "",
+	"dedication":    "",
+}
+
+// This matches short names of Creative Commons licenses, like "CC BY-NC 4.0",
+// "CC-BY-4.0" or "CC0".
+var creativeCommonsNameRegex = regexp.MustCompile(`^cc(?:[\s_-]*(0|by(?:[\s_-]+(?:nc|nd|sa))*))(?:[\s_-]*\d+(?:\.\d+)*)?(?:\s.*)?$`)
+
+var licenseSeparatorRegex = regexp.MustCompile(`[\s_-]+`)
+
+func normalizeCreativeCommonsUrl(licenseUrl *url.URL) (string, bool) {
+	if !strings.HasSuffix(licenseUrl.Hostname(), creativeCommonsHostname) {
+		return "", false
+	}
+
+	pathSegments := strings.Split(strings.Trim(licenseUrl.Path, "/"), "/")
+	if len(pathSegments) < 2 {
+		return "", false
+	}
+
+	switch pathSegments[0] {
+	case "licenses":
+		return "cc-" + pathSegments[1], true
+	case "publicdomain":
+		if pathSegments[1] == "zero" {
+			return "cc0", true
+		}
+
+		return publicDomainLicense, true
+	default:
+		return "", false
+	}
+}
+
+func normalizeCreativeCommonsName(rawLicense string) (string, bool) {
+	if matches := creativeCommonsNameRegex.FindStringSubmatch(rawLicense); matches != nil {
+		if matches[1] == "0" {
+			return "cc0", true
+		}
+
+		return "cc-" + licenseSeparatorRegex.ReplaceAllString(matches[1], "-"), true
+	}
+
+	if !strings.HasPrefix(rawLicense, "creative commons") {
+		return "", false
+	}
+
+	var elements []string
+
+	for _, word := range strings.FieldsFunc(rawLicense, func(r rune) bool { return r == ' ' || r == '-' || r == '/' || r == '(' || r == ')' }) {
+		element, isElement := creativeCommonsElements[word]
+
+		switch {
+		case isElement && element != "":
+			elements = append(elements, element)
+		case !isElement && strings.Trim(word, "0123456789.") != "":
+			return "", false
+		}
+	}
+
+	switch {
+	case len(elements) == 0:
+		return "", false
+	case elements[0] == "0":
+		return "cc0", true
+	default:
+		return "cc-" + strings.Join(elements, "-"), true
+	}
+}
+
+// NormalizeLicense converts the name or URL of a license to a short lowercase
+// identifier like the ones Unpaywall uses (e.g. `cc-by`, `cc-by-nc-sa` or
+// `cc0`), so that licenses from different sources can be compared. Licenses
+// which aren't recognized are lowercased.
+func NormalizeLicense(rawLicense string) string {
+	license := strings.ToLower(strings.TrimSpace(rawLicense))
+
+	if licenseUrl, err := url.Parse(license); err == nil && licenseUrl.Host != "" {
+		if normalized, ok := normalizeCreativeCommonsUrl(licenseUrl); ok {
+			return normalized
+		}
+
+		return license
+	}
+
+	if normalized, ok := normalizeCreativeCommonsName(license); ok {
+		return normalized
+	}
+
+	switch license {
+	case "pd", "public domain":
+		return publicDomainLicense
+	default:
+		return license
+	}
+}
+
+// EntryLicense returns the license in the `rights` field of an entry, which is
+// where Zotero stores it.
+func EntryLicense(entry bibtex.BibEntry) *string {
+	rawLicense := BibEntryField(entry, "rights")
+	if rawLicense == nil || strings.TrimSpace(*rawLicense) == "" {
+		return nil
+	}
+
+	license := NormalizeLicense(*rawLicense)
+
+	return &license
+}
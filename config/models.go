@@ -2,12 +2,25 @@ package config
 
 import (
 	"errors"
+	"fmt"
+	"github.com/frawleyskid/ipfs-bib/network"
+	"os"
+	"time"
 )
 
 var (
-	ErrInvalidCarVersion = errors.New("CAR version must be \"1\" or \"2\"")
-	ErrMfsAndCar         = errors.New("can not add sources to MFS if exporting them as a CAR")
-	ErrPinAndCar         = errors.New("can not pin sources if exporting them as a CAR")
+	ErrInvalidCarVersion        = errors.New("CAR version must be \"1\" or \"2\"")
+	ErrInvalidPmcSource         = errors.New("PMC source must be \"europepmc\" or \"pmc\"")
+	ErrInvalidUnpaywallHostType = errors.New("Unpaywall host type must be \"publisher\" or \"repository\"")
+	ErrInvalidUnpaywallVersion  = errors.New("Unpaywall version must be \"published\", \"accepted\" or \"submitted\"")
+	ErrMfsAndCar                = errors.New("can not add sources to MFS if exporting them as a CAR")
+	ErrPinAndCar                = errors.New("can not pin sources if exporting them as a CAR")
+	ErrInvalidJobs              = errors.New("the number of jobs must be at least 1")
+	ErrNoCacheAndRefresh        = errors.New("can not refresh the download cache if it is disabled")
+	ErrPruneNoUpdate            = errors.New("can not prune sources unless updating a previous root")
+	ErrZoteroFilter             = errors.New("can not filter items unless pulling references from Zotero")
+	ErrZoteroAndLocal           = errors.New("can not pull references from both the Zotero API and a local Zotero data directory")
+	ErrRecursiveNoCollection    = errors.New("can not include subcollections unless a collection is passed")
 )
 
 type Ipfs struct {
@@ -40,13 +53,112 @@ type Archive struct {
 	FileName      string   `mapstructure:"file-name"`
 	DirectoryName string   `mapstructure:"directory-name"`
 	EmbeddedTypes []string `mapstructure:"embedded-types"`
+	FrameDepth    int      `mapstructure:"frame-depth"`
+	MetaTags      bool     `mapstructure:"meta-tags"`
 	ExcludedTypes []string `mapstructure:"excluded-types"`
 	UserAgent     string   `mapstructure:"user-agent"`
+	Jobs          int      `mapstructure:"jobs"`
 }
 
 type Unpaywall struct {
+	Enabled   bool     `mapstructure:"enabled"`
+	Email     string   `mapstructure:"email"`
+	HostTypes []string `mapstructure:"host-types"`
+	Versions  []string `mapstructure:"versions"`
+}
+
+var (
+	unpaywallHostTypes = []string{"publisher", "repository"}
+	unpaywallVersions  = []string{"published", "accepted", "submitted"}
+)
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c Unpaywall) Validate() error {
+	for _, hostType := range c.HostTypes {
+		if !containsString(unpaywallHostTypes, hostType) {
+			return fmt.Errorf("%w: %s", ErrInvalidUnpaywallHostType, hostType)
+		}
+	}
+
+	for _, version := range c.Versions {
+		if !containsString(unpaywallVersions, version) {
+			return fmt.Errorf("%w: %s", ErrInvalidUnpaywallVersion, version)
+		}
+	}
+
+	return nil
+}
+
+type Arxiv struct {
+	Enabled bool `mapstructure:"enabled"`
+}
+
+type Pmc struct {
 	Enabled bool   `mapstructure:"enabled"`
 	Email   string `mapstructure:"email"`
+	Source  string `mapstructure:"source"`
+}
+
+func (c Pmc) MaybeEmail() *string {
+	if c.Email == "" {
+		return nil
+	} else {
+		return &c.Email
+	}
+}
+
+// PreferPmc returns whether PDFs should be downloaded from PubMed Central
+// rather than Europe PMC. If the source isn't set, like in a config file
+// written before it existed, Europe PMC is used.
+func (c Pmc) PreferPmc() (bool, error) {
+	switch c.Source {
+	case "", "europepmc":
+		return false, nil
+	case "pmc":
+		return true, nil
+	default:
+		return false, ErrInvalidPmcSource
+	}
+}
+
+type Wayback struct {
+	Enabled    bool `mapstructure:"enabled"`
+	UseUrlDate bool `mapstructure:"use-urldate"`
+}
+
+type Crossref struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Email   string `mapstructure:"email"`
+	Enrich  bool   `mapstructure:"enrich"`
+}
+
+func (c Crossref) MaybeEmail() *string {
+	if c.Email == "" {
+		return nil
+	} else {
+		return &c.Email
+	}
+}
+
+type License struct {
+	Allow        []string `mapstructure:"allow"`
+	AllowUnknown bool     `mapstructure:"allow-unknown"`
+}
+
+type Validate struct {
+	Enabled              bool     `mapstructure:"enabled"`
+	PdfStructure         bool     `mapstructure:"pdf-structure"`
+	InterstitialPatterns []string `mapstructure:"interstitial-patterns"`
+	ParkedPatterns       []string `mapstructure:"parked-patterns"`
 }
 
 type Monolith struct {
@@ -79,10 +191,129 @@ type Resolver struct {
 	ExcludeHostnames []string `mapstructure:"exclude-hostnames"`
 }
 
+type HostRateLimit struct {
+	Hostname          string   `mapstructure:"hostname"`
+	RequestsPerSecond *float64 `mapstructure:"requests-per-second"`
+	Burst             *int     `mapstructure:"burst"`
+	MaxConnections    *int     `mapstructure:"max-connections"`
+}
+
+type RateLimit struct {
+	RequestsPerSecond float64         `mapstructure:"requests-per-second"`
+	Burst             int             `mapstructure:"burst"`
+	MaxConnections    int             `mapstructure:"max-connections"`
+	Hosts             []HostRateLimit `mapstructure:"hosts"`
+}
+
+func (c RateLimit) NewRateLimiter() *network.RateLimiter {
+	defaultLimit := network.HostLimit{
+		RequestsPerSecond: c.RequestsPerSecond,
+		Burst:             c.Burst,
+		MaxConnections:    c.MaxConnections,
+	}
+
+	hostLimits := make(map[string]network.HostLimit, len(c.Hosts))
+
+	// Any options which aren't set for a specific host are inherited from the
+	// global options.
+	for _, hostCfg := range c.Hosts {
+		hostLimit := defaultLimit
+
+		if hostCfg.RequestsPerSecond != nil {
+			hostLimit.RequestsPerSecond = *hostCfg.RequestsPerSecond
+		}
+
+		if hostCfg.Burst != nil {
+			hostLimit.Burst = *hostCfg.Burst
+		}
+
+		if hostCfg.MaxConnections != nil {
+			hostLimit.MaxConnections = *hostCfg.MaxConnections
+		}
+
+		hostLimits[hostCfg.Hostname] = hostLimit
+	}
+
+	return network.NewRateLimiter(defaultLimit, hostLimits)
+}
+
+type Retry struct {
+	MaxAttempts int           `mapstructure:"max-attempts"`
+	BaseDelay   time.Duration `mapstructure:"base-delay"`
+	MaxDelay    time.Duration `mapstructure:"max-delay"`
+	Jitter      float64       `mapstructure:"jitter"`
+	StatusCodes []int         `mapstructure:"status-codes"`
+}
+
+func (c Retry) Policy() network.RetryPolicy {
+	return network.RetryPolicy{
+		MaxAttempts: c.MaxAttempts,
+		BaseDelay:   c.BaseDelay,
+		MaxDelay:    c.MaxDelay,
+		Jitter:      c.Jitter,
+		StatusCodes: c.StatusCodes,
+	}
+}
+
+type Cache struct {
+	Enabled bool          `mapstructure:"enabled"`
+	Path    string        `mapstructure:"path"`
+	Ttl     time.Duration `mapstructure:"ttl"`
+	MaxSize int64         `mapstructure:"max-size"`
+}
+
+type Spool struct {
+	Path string `mapstructure:"path"`
+}
+
+type MediaTypeLimit struct {
+	MediaType   string `mapstructure:"media-type"`
+	MaxFileSize int64  `mapstructure:"max-file-size"`
+}
+
+type Limit struct {
+	MaxFileSize  int64            `mapstructure:"max-file-size"`
+	MaxTotalSize int64            `mapstructure:"max-total-size"`
+	MediaTypes   []MediaTypeLimit `mapstructure:"media-types"`
+}
+
+const ZoteroApiKeyEnv = "ZOTERO_API_KEY"
+
+type Zotero struct {
+	ApiKey         string `mapstructure:"api-key"`
+	AllAttachments bool   `mapstructure:"all-attachments"`
+}
+
+// MaybeApiKey returns the API key from the config file, or otherwise from the
+// `ZOTERO_API_KEY` environment variable.
+func (c Zotero) MaybeApiKey() *string {
+	if c.ApiKey != "" {
+		return &c.ApiKey
+	}
+
+	if apiKey := os.Getenv(ZoteroApiKeyEnv); apiKey != "" {
+		return &apiKey
+	}
+
+	return nil
+}
+
 type File struct {
 	Ipfs      Ipfs       `mapstructure:"ipfs"`
 	Archive   Archive    `mapstructure:"archive"`
+	RateLimit RateLimit  `mapstructure:"rate-limit"`
+	Retry     Retry      `mapstructure:"retry"`
+	Cache     Cache      `mapstructure:"cache"`
+	Spool     Spool      `mapstructure:"spool"`
+	Limit     Limit      `mapstructure:"limit"`
+	Zotero    Zotero     `mapstructure:"zotero"`
+	Arxiv     Arxiv      `mapstructure:"arxiv"`
 	Unpaywall Unpaywall  `mapstructure:"unpaywall"`
+	Crossref  Crossref   `mapstructure:"crossref"`
+	Pmc       Pmc        `mapstructure:"pmc"`
+	Wayback   Wayback    `mapstructure:"wayback"`
+	License   License    `mapstructure:"license"`
+	Validate  Validate   `mapstructure:"validate"`
 	Monolith  Monolith   `mapstructure:"monolith"`
 	Snapshot  Snapshot   `mapstructure:"snapshot"`
 	Pins      []Pin      `mapstructure:"pins"`
@@ -90,16 +321,29 @@ type File struct {
 }
 
 type Flags struct {
-	CarPath       string `mapstructure:"car"`
-	ConfigPath    string `mapstructure:"config"`
-	DryRun        bool   `mapstructure:"dry-run"`
-	JsonOutput    bool   `mapstructure:"json"`
-	MfsPath       string `mapstructure:"mfs"`
-	OutputPath    string `mapstructure:"output"`
-	PinLocal      bool   `mapstructure:"pin"`
-	PinRemoteName string `mapstructure:"pin-remote"`
-	Verbose       bool   `mapstructure:"verbose"`
-	UseZotero     bool   `mapstructure:"zotero"`
+	CarPath          string   `mapstructure:"car"`
+	ConfigPath       string   `mapstructure:"config"`
+	DryRun           bool     `mapstructure:"dry-run"`
+	Format           string   `mapstructure:"format"`
+	Jobs             int      `mapstructure:"jobs"`
+	JsonOutput       bool     `mapstructure:"json"`
+	MfsPath          string   `mapstructure:"mfs"`
+	NoCache          bool     `mapstructure:"no-cache"`
+	OutputFormat     string   `mapstructure:"output-format"`
+	OutputPath       string   `mapstructure:"output"`
+	PinLocal         bool     `mapstructure:"pin"`
+	PinRemoteName    string   `mapstructure:"pin-remote"`
+	Prune            bool     `mapstructure:"prune"`
+	Refresh          bool     `mapstructure:"refresh"`
+	StateDir         string   `mapstructure:"state-dir"`
+	UpdateFrom       string   `mapstructure:"update-from"`
+	Verbose          bool     `mapstructure:"verbose"`
+	UseZotero        bool     `mapstructure:"zotero"`
+	ZoteroCollection string   `mapstructure:"zotero-collection"`
+	ZoteroRecursive  bool     `mapstructure:"zotero-recursive"`
+	ZoteroTags       []string `mapstructure:"zotero-tag"`
+	ZoteroItemType   string   `mapstructure:"zotero-item-type"`
+	ZoteroLocal      string   `mapstructure:"zotero-local"`
 }
 
 func (f Flags) MaybeCarPath() *string {
@@ -118,6 +362,22 @@ func (f Flags) MaybeConfigPath() *string {
 	}
 }
 
+func (f Flags) MaybeFormat() *string {
+	if f.Format == "" {
+		return nil
+	} else {
+		return &f.Format
+	}
+}
+
+func (f Flags) MaybeJobs() *int {
+	if f.Jobs == 0 {
+		return nil
+	} else {
+		return &f.Jobs
+	}
+}
+
 func (f Flags) MaybeMfsPath() *string {
 	if f.MfsPath == "" {
 		return nil
@@ -126,6 +386,14 @@ func (f Flags) MaybeMfsPath() *string {
 	}
 }
 
+func (f Flags) MaybeOutputFormat() *string {
+	if f.OutputFormat == "" {
+		return nil
+	} else {
+		return &f.OutputFormat
+	}
+}
+
 func (f Flags) MaybeOutputPath() *string {
 	if f.OutputPath == "" {
 		return nil
@@ -142,6 +410,46 @@ func (f Flags) MaybePinRemoteName() *string {
 	}
 }
 
+func (f Flags) MaybeStateDir() *string {
+	if f.StateDir == "" {
+		return nil
+	} else {
+		return &f.StateDir
+	}
+}
+
+func (f Flags) MaybeUpdateFrom() *string {
+	if f.UpdateFrom == "" {
+		return nil
+	} else {
+		return &f.UpdateFrom
+	}
+}
+
+func (f Flags) MaybeZoteroCollection() *string {
+	if f.ZoteroCollection == "" {
+		return nil
+	} else {
+		return &f.ZoteroCollection
+	}
+}
+
+func (f Flags) MaybeZoteroItemType() *string {
+	if f.ZoteroItemType == "" {
+		return nil
+	} else {
+		return &f.ZoteroItemType
+	}
+}
+
+func (f Flags) MaybeZoteroLocal() *string {
+	if f.ZoteroLocal == "" {
+		return nil
+	} else {
+		return &f.ZoteroLocal
+	}
+}
+
 func (f Flags) Validate() error {
 	if f.MaybeCarPath() != nil && f.MaybeMfsPath() != nil {
 		return ErrMfsAndCar
@@ -151,6 +459,31 @@ func (f Flags) Validate() error {
 		return ErrPinAndCar
 	}
 
+	if f.UseZotero && f.MaybeZoteroLocal() != nil {
+		return ErrZoteroAndLocal
+	}
+
+	hasZoteroFilter := f.MaybeZoteroCollection() != nil || len(f.ZoteroTags) > 0 || f.MaybeZoteroItemType() != nil
+	if hasZoteroFilter && !f.UseZotero && f.MaybeZoteroLocal() == nil {
+		return ErrZoteroFilter
+	}
+
+	if f.ZoteroRecursive && f.MaybeZoteroCollection() == nil {
+		return ErrRecursiveNoCollection
+	}
+
+	if f.Prune && f.MaybeUpdateFrom() == nil {
+		return ErrPruneNoUpdate
+	}
+
+	if f.NoCache && f.Refresh {
+		return ErrNoCacheAndRefresh
+	}
+
+	if f.Jobs < 0 {
+		return ErrInvalidJobs
+	}
+
 	return nil
 }
 
@@ -158,3 +491,17 @@ type Config struct {
 	File  File
 	Flags Flags
 }
+
+func (c Config) Jobs() int {
+	jobs := c.File.Archive.Jobs
+
+	if flagJobs := c.Flags.MaybeJobs(); flagJobs != nil {
+		jobs = *flagJobs
+	}
+
+	if jobs < 1 {
+		return 1
+	}
+
+	return jobs
+}
@@ -22,9 +22,11 @@ type SourcePath struct {
 }
 
 type SourcePathTemplate struct {
-	filename        template.Template
-	directory       template.Template
-	occurrenceCount map[string]int
+	filename         template.Template
+	directory        template.Template
+	occurrenceCount  map[string]int
+	directoryByCite  map[string]string
+	takenDirectories map[string]struct{}
 }
 
 func NewSourcePathTemplate(cfg Config) (SourcePathTemplate, error) {
@@ -39,47 +41,73 @@ func NewSourcePathTemplate(cfg Config) (SourcePathTemplate, error) {
 	}
 
 	return SourcePathTemplate{
-		filename:        *filename,
-		directory:       *directory,
-		occurrenceCount: make(map[string]int),
+		filename:         *filename,
+		directory:        *directory,
+		occurrenceCount:  make(map[string]int),
+		directoryByCite:  make(map[string]string),
+		takenDirectories: make(map[string]struct{}),
 	}, nil
 }
 
-func (s SourcePathTemplate) Execute(entry bibtex.BibEntry, originalFileName string, mediaType string) SourcePath {
-	var filenameBytes bytes.Buffer
+func (s SourcePathTemplate) executeDirectory(entry bibtex.BibEntry, ordinal int) string {
 	var directoryBytes bytes.Buffer
 
-	filenameInput := newFileNameTemplateInput(entry, originalFileName, mediaType)
-	directoryInput := newDirectoryNameTemplateInput(entry, 0)
-
-	if err := s.filename.Execute(&filenameBytes, filenameInput); err != nil {
+	if err := s.directory.Execute(&directoryBytes, newDirectoryNameTemplateInput(entry, ordinal)); err != nil {
 		logging.Error.Fatal(err)
 	}
 
-	if err := s.directory.Execute(&directoryBytes, directoryInput); err != nil {
-		logging.Error.Fatal(err)
+	return directoryBytes.String()
+}
+
+// Directory returns the name of the directory for the given entry. The first
+// time each cite name is seen, it's given a directory which no other entry has,
+// so entries must be passed in the same order every time for them to get the
+// same directories.
+func (s SourcePathTemplate) Directory(entry bibtex.BibEntry) string {
+	// If we've already picked a directory for this cite name, we reuse it,
+	// because a better source may be found for an entry after it has already
+	// been stored.
+	if directoryName, ok := s.directoryByCite[entry.CiteName]; ok {
+		return directoryName
 	}
 
 	// We execute the directory template with an ordinal value of `0` first, so
 	// we can determine whether it has been duplicated or not.
-	ordinal := s.occurrenceCount[directoryBytes.String()]
-	s.occurrenceCount[directoryBytes.String()] = ordinal + 1
+	firstDirectoryName := s.executeDirectory(entry, 0)
 
-	if ordinal > 0 {
-		directoryInput.Ordinal = ordinal
-		directoryBytes.Reset()
+	ordinal := s.occurrenceCount[firstDirectoryName]
+	directoryName := strings.ReplaceAll(s.executeDirectory(entry, ordinal), "/", "-")
 
-		if err := s.directory.Execute(&directoryBytes, directoryInput); err != nil {
-			logging.Error.Fatal(err)
+	// Another entry may have already been given this name by a different
+	// ordinal, so we keep counting until we find one which is free.
+	for {
+		if _, taken := s.takenDirectories[directoryName]; !taken {
+			break
 		}
+
+		ordinal++
+		directoryName = strings.ReplaceAll(s.executeDirectory(entry, ordinal), "/", "-")
 	}
 
-	sanitizedFileName := strings.ReplaceAll(filenameBytes.String(), "/", "-")
-	sanitizedDirectoryName := strings.ReplaceAll(directoryBytes.String(), "/", "-")
+	s.occurrenceCount[firstDirectoryName] = ordinal + 1
+	s.takenDirectories[directoryName] = struct{}{}
+	s.directoryByCite[entry.CiteName] = directoryName
+
+	return directoryName
+}
+
+func (s SourcePathTemplate) Execute(entry bibtex.BibEntry, originalFileName string, mediaType string) SourcePath {
+	var filenameBytes bytes.Buffer
+
+	filenameInput := newFileNameTemplateInput(entry, originalFileName, mediaType)
+
+	if err := s.filename.Execute(&filenameBytes, filenameInput); err != nil {
+		logging.Error.Fatal(err)
+	}
 
 	return SourcePath{
-		FileName:      sanitizedFileName,
-		DirectoryName: sanitizedDirectoryName,
+		FileName:      strings.ReplaceAll(filenameBytes.String(), "/", "-"),
+		DirectoryName: s.Directory(entry),
 	}
 }
 
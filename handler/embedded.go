@@ -1,27 +1,73 @@
 package handler
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/frawleyskid/ipfs-bib/config"
 	"github.com/frawleyskid/ipfs-bib/logging"
 	"github.com/frawleyskid/ipfs-bib/network"
+	"github.com/frawleyskid/ipfs-bib/spool"
 	"golang.org/x/net/html"
 	"golang.org/x/net/html/atom"
-	"io"
 	"net/http"
 	"net/url"
+	"strings"
 )
 
-const DefaultUrlScheme = "https"
+// This is the most iframes we follow on a single page, so that pages full of
+// ads don't send us down a rabbit hole.
+const maxFramesPerPage = 8
 
+var pdfViewerMediaTypeHint = "application/pdf"
+
+// unwrapViewerUrl returns the URL of the document shown by a document viewer,
+// like PDF.js (`viewer.html?file=`) or the Google Docs viewer (`viewer?url=`),
+// or nil if the URL isn't a known viewer. Since PDF.js only shows PDFs, it
+// also returns a media type hint for PDF.js viewers.
+func unwrapViewerUrl(viewerUrl url.URL) (*url.URL, *string) {
+	viewerPath := strings.ToLower(viewerUrl.Path)
+
+	var (
+		rawDocumentUrl string
+		mediaTypeHint  *string
+	)
+
+	switch {
+	case strings.Contains(viewerPath, "pdfjs") || strings.HasSuffix(viewerPath, "/viewer.html"):
+		rawDocumentUrl = viewerUrl.Query().Get("file")
+		mediaTypeHint = &pdfViewerMediaTypeHint
+	case viewerUrl.Hostname() == "docs.google.com" && (strings.HasSuffix(viewerPath, "/viewer") || strings.HasSuffix(viewerPath, "/gview")):
+		rawDocumentUrl = viewerUrl.Query().Get("url")
+	}
+
+	if rawDocumentUrl == "" {
+		return nil, nil
+	}
+
+	documentUrl, err := url.Parse(rawDocumentUrl)
+	if err != nil {
+		logging.Verbose.Println(fmt.Errorf("%w: %v", network.ErrUnmarshalResponse, err))
+		return nil, nil
+	}
+
+	// PDF.js resolves the file relative to the viewer.
+	return viewerUrl.ResolveReference(documentUrl), mediaTypeHint
+}
+
+// EmbeddedHandler finds documents embedded in a web page in `<object>` and
+// `<embed>` tags, following iframes up to a maximum depth and unwrapping
+// document viewers along the way.
 type EmbeddedHandler struct {
-	tagFinder  *TagFinder
-	httpClient *network.HttpClient
+	documentFinder *TagFinder
+	frameFinder    *TagFinder
+	mediaTypes     map[string]struct{}
+	frameDepth     int
+	httpClient     *network.HttpClient
+	sourceSpool    *spool.Spool
 }
 
-func NewEmbeddedHandler(userAgent string, mediaTypes []string) DownloadHandler {
+func NewEmbeddedHandler(httpClient *network.HttpClient, sourceSpool *spool.Spool, mediaTypes []string, frameDepth int) DownloadHandler {
 	if len(mediaTypes) == 0 {
 		return &NoOpHandler{}
 	}
@@ -32,28 +78,111 @@ func NewEmbeddedHandler(userAgent string, mediaTypes []string) DownloadHandler {
 	}
 
 	return &EmbeddedHandler{
-		tagFinder: NewTagFinder(func(node html.Node) bool {
+		documentFinder: NewTagFinder(func(node html.Node) bool {
 			if node.Type == html.ElementNode && (node.DataAtom == atom.Object || node.DataAtom == atom.Embed) {
+				// Tags without a type may still embed a document, which we
+				// find out when we download it.
 				if value := FindAttr(node, "type"); value != nil {
 					_, exists := mediaTypeSet[*value]
 					return exists
 				}
+
+				return true
 			}
 
 			return false
 		}),
-		httpClient: network.NewClient(userAgent),
+		frameFinder: NewTagFinder(func(node html.Node) bool {
+			return node.Type == html.ElementNode && node.DataAtom == atom.Iframe && FindAttr(node, "src") != nil
+		}),
+		mediaTypes:  mediaTypeSet,
+		frameDepth:  frameDepth,
+		httpClient:  httpClient,
+		sourceSpool: sourceSpool,
 	}
 }
 
-func (e *EmbeddedHandler) Handle(ctx context.Context, response DownloadResponse) (SourceContent, error) {
-	if response.MediaType() != network.HtmlMediaType {
+// download requests a URL linked from a page, unwrapping it first if it's a
+// document viewer. URLs which were already visited return ErrNotHandled, so
+// pages which embed each other don't loop forever.
+func (e *EmbeddedHandler) download(ctx context.Context, contentUrl url.URL, mediaTypeHint *string, visited map[string]struct{}) (DownloadResponse, error) {
+	if documentUrl, viewerMediaTypeHint := unwrapViewerUrl(contentUrl); documentUrl != nil {
+		contentUrl = *documentUrl
+
+		if viewerMediaTypeHint != nil {
+			mediaTypeHint = viewerMediaTypeHint
+		}
+	}
+
+	if _, seen := visited[contentUrl.String()]; seen {
+		return DownloadResponse{}, ErrNotHandled
+	}
+
+	visited[contentUrl.String()] = struct{}{}
+
+	response, err := e.httpClient.Request(ctx, http.MethodGet, contentUrl)
+	if err != nil {
+		return DownloadResponse{}, err
+	}
+
+	content, err := SpoolResponse(e.sourceSpool, response, mediaTypeHint)
+	if err != nil {
+		return DownloadResponse{}, err
+	}
+
+	return DownloadResponse{
+		Url:           contentUrl,
+		Body:          content,
+		Header:        response.Header,
+		MediaTypeHint: mediaTypeHint,
+	}, nil
+}
+
+// toContent returns the content of a response if it's one of the media types
+// we're looking for. The `type` attribute of the tag which linked to it is only
+// used as a hint, because it's often wrong.
+func (e *EmbeddedHandler) toContent(response DownloadResponse) (SourceContent, error) {
+	mediaType := response.MediaType()
+
+	if _, ok := e.mediaTypes[mediaType]; !ok {
 		return SourceContent{}, ErrNotHandled
 	}
 
-	rootNode, err := html.Parse(bytes.NewReader(response.Body))
+	return SourceContent{
+		Content:   response.Body,
+		MediaType: mediaType,
+		FileName:  config.InferFileName(&response.Url, mediaType, response.Header),
+		Url:       response.Url,
+	}, nil
+}
+
+// followFrame downloads the page in an iframe, which may either be the
+// document itself or another page to search.
+func (e *EmbeddedHandler) followFrame(ctx context.Context, frameUrl url.URL, depth int, visited map[string]struct{}) (SourceContent, error) {
+	frameResponse, err := e.download(ctx, frameUrl, nil, visited)
 	if err != nil {
-		return SourceContent{}, fmt.Errorf("%w: %v", network.ErrUnmarshalResponse, err)
+		return SourceContent{}, err
+	}
+
+	if frameResponse.MediaType() == network.HtmlMediaType {
+		content, err := e.searchPage(ctx, frameResponse, depth, visited)
+		frameResponse.Body.Remove()
+
+		return content, err
+	}
+
+	content, err := e.toContent(frameResponse)
+	if err != nil {
+		frameResponse.Body.Remove()
+	}
+
+	return content, err
+}
+
+func (e *EmbeddedHandler) searchPage(ctx context.Context, response DownloadResponse, depth int, visited map[string]struct{}) (SourceContent, error) {
+	rootNode, err := parsePage(response.Body)
+	if err != nil {
+		return SourceContent{}, err
 	}
 
 	documentNode := FindChild(*rootNode, func(node html.Node) bool {
@@ -64,67 +193,88 @@ func (e *EmbeddedHandler) Handle(ctx context.Context, response DownloadResponse)
 		return SourceContent{}, ErrNotHandled
 	}
 
-	var embeddedNode html.Node
+	for _, embeddedNode := range e.documentFinder.FindAll(documentNode) {
+		var rawContentUrl *string
 
-	if node := e.tagFinder.Find(documentNode); node != nil {
-		embeddedNode = *node
-	} else {
-		return SourceContent{}, ErrNotHandled
-	}
+		switch embeddedNode.DataAtom {
+		case atom.Object:
+			rawContentUrl = FindAttr(*embeddedNode, "data")
+		case atom.Embed:
+			rawContentUrl = FindAttr(*embeddedNode, "src")
+		default:
+			logging.Error.Fatal("unexpected HTML node type")
+		}
 
-	var rawContentUrl string
+		if rawContentUrl == nil {
+			continue
+		}
 
-	switch embeddedNode.DataAtom {
-	case atom.Object:
-		if value := FindAttr(embeddedNode, "data"); value != nil {
-			rawContentUrl = *value
-		} else {
-			return SourceContent{}, ErrNotHandled
+		contentUrl, err := url.Parse(*rawContentUrl)
+		if err != nil {
+			logging.Verbose.Println(fmt.Errorf("%w: %v", network.ErrUnmarshalResponse, err))
+			continue
 		}
-	case atom.Embed:
-		if value := FindAttr(embeddedNode, "src"); value != nil {
-			rawContentUrl = *value
-		} else {
-			return SourceContent{}, ErrNotHandled
+
+		embeddedResponse, err := e.download(ctx, *response.Url.ResolveReference(contentUrl), FindAttr(*embeddedNode, "type"), visited)
+		if err == nil {
+			content, err := e.toContent(embeddedResponse)
+			if err == nil {
+				return content, nil
+			}
+
+			embeddedResponse.Body.Remove()
+		} else if !errors.Is(err, ErrNotHandled) {
+			logging.Verbose.Println(err)
 		}
-	default:
-		logging.Error.Fatal("unexpected HTML node type")
 	}
 
-	contentUrl, err := url.Parse(rawContentUrl)
-	if err != nil {
-		return SourceContent{}, fmt.Errorf("%w: %v", network.ErrUnmarshalResponse, err)
+	if depth >= e.frameDepth {
+		return SourceContent{}, ErrNotHandled
 	}
 
-	if contentUrl.Scheme == "" {
-		contentUrl.Scheme = DefaultUrlScheme
-	}
+	for index, frameNode := range e.frameFinder.FindAll(documentNode) {
+		if index >= maxFramesPerPage {
+			break
+		}
 
-	embeddedResponse, err := e.httpClient.Request(ctx, http.MethodGet, *contentUrl)
-	if err != nil {
-		return SourceContent{}, err
-	}
+		frameUrl, err := url.Parse(*FindAttr(*frameNode, "src"))
+		if err != nil {
+			logging.Verbose.Println(fmt.Errorf("%w: %v", network.ErrUnmarshalResponse, err))
+			continue
+		}
 
-	content, err := io.ReadAll(embeddedResponse.Body)
-	if err != nil {
-		return SourceContent{}, fmt.Errorf("%w: %v", network.ErrHttp, err)
+		content, err := e.followFrame(ctx, *response.Url.ResolveReference(frameUrl), depth+1, visited)
+		if err == nil {
+			return content, nil
+		} else if !errors.Is(err, ErrNotHandled) {
+			logging.Verbose.Println(err)
+		}
 	}
 
-	if err := embeddedResponse.Body.Close(); err != nil {
-		return SourceContent{}, fmt.Errorf("%w: %v", network.ErrHttp, err)
+	return SourceContent{}, ErrNotHandled
+}
+
+func (e *EmbeddedHandler) Handle(ctx context.Context, response DownloadResponse) (SourceContent, error) {
+	if response.MediaType() != network.HtmlMediaType {
+		return SourceContent{}, ErrNotHandled
 	}
 
-	var mediaType string
+	visited := map[string]struct{}{response.Url.String(): {}}
+
+	// The page may itself be a document viewer.
+	if documentUrl, _ := unwrapViewerUrl(response.Url); documentUrl != nil {
+		viewerResponse, err := e.download(ctx, response.Url, nil, visited)
+		if err == nil {
+			content, err := e.toContent(viewerResponse)
+			if err == nil {
+				return content, nil
+			}
 
-	if maybeMediaType := FindAttr(embeddedNode, "type"); maybeMediaType != nil {
-		mediaType = *maybeMediaType
-	} else {
-		logging.Error.Fatal("node unexpectedly missing its content type")
+			viewerResponse.Body.Remove()
+		} else if !errors.Is(err, ErrNotHandled) {
+			logging.Verbose.Println(err)
+		}
 	}
 
-	return SourceContent{
-		Content:   content,
-		MediaType: mediaType,
-		FileName:  config.InferFileName(contentUrl, mediaType, embeddedResponse.Header),
-	}, nil
+	return e.searchPage(ctx, response, 0, visited)
 }
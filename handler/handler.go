@@ -3,8 +3,11 @@ package handler
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/frawleyskid/ipfs-bib/config"
 	"github.com/frawleyskid/ipfs-bib/network"
+	"github.com/frawleyskid/ipfs-bib/spool"
+	"io"
 	"mime"
 	"net/http"
 	"net/url"
@@ -13,14 +16,18 @@ import (
 var ErrNotHandled = errors.New("handler could not handle content")
 
 type SourceContent struct {
-	Content   []byte
+	Content   *spool.File
 	MediaType string
 	FileName  string
+
+	// The URL the content was downloaded from, which may be different from the
+	// URL of the response passed to the handler.
+	Url url.URL
 }
 
 type DownloadResponse struct {
 	Url           url.URL
-	Body          []byte
+	Body          *spool.File
 	Header        http.Header
 	MediaTypeHint *string
 }
@@ -39,6 +46,49 @@ func (r DownloadResponse) MediaType() string {
 	return mediaType
 }
 
+// wrappingReader wraps the errors from reading with a sentinel error, so they
+// can be told apart from errors writing to the spool.
+type wrappingReader struct {
+	reader   io.Reader
+	sentinel error
+}
+
+func (r wrappingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return n, fmt.Errorf("%w: %v", r.sentinel, err)
+	}
+
+	return n, err
+}
+
+// SpoolResponse copies the body of a response into the spool and closes it.
+// If the response advertises a `Content-Length` larger than the maximum file
+// size, this returns ErrTooLarge without reading it.
+func SpoolResponse(sourceSpool *spool.Spool, response *http.Response, mediaTypeHint *string) (*spool.File, error) {
+	mediaType := DownloadResponse{Header: response.Header, MediaTypeHint: mediaTypeHint}.MediaType()
+
+	var (
+		body *spool.File
+		err  error
+	)
+
+	if response.ContentLength >= 0 {
+		err = sourceSpool.CheckSize(response.ContentLength, mediaType)
+	}
+
+	if err == nil {
+		body, err = sourceSpool.Write(wrappingReader{response.Body, network.ErrHttp}, mediaType)
+	}
+
+	if closeErr := response.Body.Close(); closeErr != nil && err == nil {
+		body.Remove()
+		return nil, fmt.Errorf("%w: %v", network.ErrHttp, closeErr)
+	}
+
+	return body, err
+}
+
 type DownloadHandler interface {
 	Handle(ctx context.Context, response DownloadResponse) (SourceContent, error)
 }
@@ -62,6 +112,7 @@ func (s *DirectHandler) Handle(_ context.Context, response DownloadResponse) (So
 		Content:   response.Body,
 		MediaType: response.MediaType(),
 		FileName:  config.InferFileName(&response.Url, response.MediaType(), response.Header),
+		Url:       response.Url,
 	}, nil
 }
 
@@ -71,10 +122,13 @@ func (n *NoOpHandler) Handle(_ context.Context, _ DownloadResponse) (SourceConte
 	return SourceContent{}, ErrNotHandled
 }
 
-func FromConfig(cfg config.Config) DownloadHandler {
+func FromConfig(cfg config.Config, httpClient *network.HttpClient, sourceSpool *spool.Spool) DownloadHandler {
+	validator := NewValidator(cfg)
+
 	return MultiHandler{
-		NewEmbeddedHandler(cfg.File.Archive.UserAgent, cfg.File.Archive.EmbeddedTypes),
-		NewMonolithHandler(cfg),
-		NewDirectHandler([]string{network.HtmlMediaType}),
+		validator.Wrap(NewEmbeddedHandler(httpClient, sourceSpool, cfg.File.Archive.EmbeddedTypes, cfg.File.Archive.FrameDepth)),
+		validator.Wrap(NewMetaTagHandler(cfg, httpClient, sourceSpool)),
+		validator.Wrap(NewMonolithHandler(cfg, sourceSpool)),
+		validator.Wrap(NewDirectHandler([]string{network.HtmlMediaType})),
 	}
 }
@@ -1,9 +1,32 @@
 package handler
 
 import (
+	"bytes"
+	"fmt"
+	"github.com/frawleyskid/ipfs-bib/network"
+	"github.com/frawleyskid/ipfs-bib/spool"
 	"golang.org/x/net/html"
 )
 
+// This is the most of a web page we read to parse it, so that huge pages
+// aren't held in memory. Anything we're looking for is almost always near the
+// top.
+const maxPageSize = 8 * 1024 * 1024
+
+func parsePage(body *spool.File) (*html.Node, error) {
+	content, err := body.Prefix(maxPageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	rootNode, err := html.Parse(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", network.ErrUnmarshalResponse, err)
+	}
+
+	return rootNode, nil
+}
+
 func FindAttr(node html.Node, key string) (value *string) {
 	for _, attr := range node.Attr {
 		if attr.Key == key {
@@ -71,3 +94,29 @@ func (f *TagFinder) Find(node *html.Node) *html.Node {
 
 	return nil
 }
+
+func (f *TagFinder) walkAll(nodes []html.Node, found []*html.Node) []*html.Node {
+	for index, node := range nodes {
+		if f.predicate(node) {
+			found = append(found, &nodes[index])
+		}
+	}
+
+	for _, node := range nodes {
+		if child := node.FirstChild; child != nil {
+			found = f.walkAll(findSiblings(*child), found)
+		}
+	}
+
+	return found
+}
+
+// FindAll is like Find, but returns every matching node in the order Find
+// would find them.
+func (f *TagFinder) FindAll(node *html.Node) []*html.Node {
+	if child := node.FirstChild; child != nil {
+		return f.walkAll(findSiblings(*child), nil)
+	}
+
+	return nil
+}
@@ -0,0 +1,182 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/frawleyskid/ipfs-bib/config"
+	"github.com/frawleyskid/ipfs-bib/logging"
+	"github.com/frawleyskid/ipfs-bib/network"
+	"github.com/frawleyskid/ipfs-bib/spool"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var metaTagMediaTypeHint = "application/pdf"
+
+// These are the names of `<meta>` tags which publishers and repositories use
+// to link to the PDF of an article, in order of preference. The `citation_*`
+// tags are the Highwire Press tags which Google Scholar reads.
+var pdfMetaTagNames = []string{
+	"citation_pdf_url",
+	"bepress_citation_pdf_url",
+	"eprints.document_url",
+	"wkhealth_pdf_url",
+}
+
+func isPdfMetaTag(name string) func(html.Node) bool {
+	return func(node html.Node) bool {
+		if node.Type != html.ElementNode || node.DataAtom != atom.Meta {
+			return false
+		}
+
+		value := FindAttr(node, "name")
+
+		return value != nil && strings.EqualFold(*value, name) && FindAttr(node, "content") != nil
+	}
+}
+
+func isPdfAlternateLink(node html.Node) bool {
+	if node.Type != html.ElementNode || node.DataAtom != atom.Link {
+		return false
+	}
+
+	rel, mediaType := FindAttr(node, "rel"), FindAttr(node, "type")
+	if rel == nil || mediaType == nil || FindAttr(node, "href") == nil {
+		return false
+	}
+
+	for _, relValue := range strings.Fields(*rel) {
+		if strings.EqualFold(relValue, "alternate") {
+			return strings.EqualFold(*mediaType, metaTagMediaTypeHint)
+		}
+	}
+
+	return false
+}
+
+// MetaTagHandler follows the links to PDFs which many publisher landing pages
+// advertise in their `<meta>` and `<link>` tags.
+type MetaTagHandler struct {
+	tagFinders  []*TagFinder
+	httpClient  *network.HttpClient
+	sourceSpool *spool.Spool
+}
+
+func NewMetaTagHandler(cfg config.Config, httpClient *network.HttpClient, sourceSpool *spool.Spool) DownloadHandler {
+	if !cfg.File.Archive.MetaTags {
+		return &NoOpHandler{}
+	}
+
+	tagFinders := make([]*TagFinder, 0, len(pdfMetaTagNames)+1)
+
+	for _, name := range pdfMetaTagNames {
+		tagFinders = append(tagFinders, NewTagFinder(isPdfMetaTag(name)))
+	}
+
+	tagFinders = append(tagFinders, NewTagFinder(isPdfAlternateLink))
+
+	return &MetaTagHandler{tagFinders, httpClient, sourceSpool}
+}
+
+// pdfUrls returns the PDF URLs linked from the page, in order of preference
+// and without duplicates.
+func (m *MetaTagHandler) pdfUrls(documentNode *html.Node, pageUrl url.URL) []url.URL {
+	var pdfUrls []url.URL
+
+	seenUrls := make(map[string]struct{})
+
+	for _, tagFinder := range m.tagFinders {
+		node := tagFinder.Find(documentNode)
+		if node == nil {
+			continue
+		}
+
+		var rawPdfUrl *string
+
+		switch node.DataAtom {
+		case atom.Meta:
+			rawPdfUrl = FindAttr(*node, "content")
+		case atom.Link:
+			rawPdfUrl = FindAttr(*node, "href")
+		default:
+			logging.Error.Fatal("unexpected HTML node type")
+		}
+
+		pdfUrl, err := url.Parse(strings.TrimSpace(*rawPdfUrl))
+		if err != nil {
+			logging.Verbose.Println(fmt.Errorf("%w: %v", network.ErrUnmarshalResponse, err))
+			continue
+		}
+
+		// These URLs are often relative to the landing page.
+		pdfUrl = pageUrl.ResolveReference(pdfUrl)
+
+		if _, seen := seenUrls[pdfUrl.String()]; seen {
+			continue
+		}
+
+		seenUrls[pdfUrl.String()] = struct{}{}
+		pdfUrls = append(pdfUrls, *pdfUrl)
+	}
+
+	return pdfUrls
+}
+
+func (m *MetaTagHandler) download(ctx context.Context, pdfUrl url.URL) (SourceContent, error) {
+	pdfResponse, err := m.httpClient.Request(ctx, http.MethodGet, pdfUrl)
+	if err != nil {
+		return SourceContent{}, err
+	}
+
+	content, err := SpoolResponse(m.sourceSpool, pdfResponse, &metaTagMediaTypeHint)
+	if err != nil {
+		return SourceContent{}, err
+	}
+
+	downloadResponse := DownloadResponse{
+		Url:           pdfUrl,
+		Body:          content,
+		Header:        pdfResponse.Header,
+		MediaTypeHint: &metaTagMediaTypeHint,
+	}
+
+	// Publishers often send paywalled readers to a login page instead of the
+	// PDF.
+	if downloadResponse.MediaType() == network.HtmlMediaType {
+		content.Remove()
+		return SourceContent{}, ErrNotHandled
+	}
+
+	return SourceContent{
+		Content:   content,
+		MediaType: downloadResponse.MediaType(),
+		FileName:  config.InferFileName(&pdfUrl, downloadResponse.MediaType(), pdfResponse.Header),
+		Url:       pdfUrl,
+	}, nil
+}
+
+func (m *MetaTagHandler) Handle(ctx context.Context, response DownloadResponse) (SourceContent, error) {
+	if response.MediaType() != network.HtmlMediaType {
+		return SourceContent{}, ErrNotHandled
+	}
+
+	rootNode, err := parsePage(response.Body)
+	if err != nil {
+		return SourceContent{}, err
+	}
+
+	for _, pdfUrl := range m.pdfUrls(rootNode, response.Url) {
+		content, err := m.download(ctx, pdfUrl)
+		if err == nil {
+			return content, nil
+		} else if !errors.Is(err, ErrNotHandled) {
+			logging.Verbose.Println(err)
+		}
+	}
+
+	return SourceContent{}, ErrNotHandled
+}
@@ -1,23 +1,25 @@
 package handler
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"github.com/frawleyskid/ipfs-bib/config"
+	"github.com/frawleyskid/ipfs-bib/logging"
 	"github.com/frawleyskid/ipfs-bib/network"
+	"github.com/frawleyskid/ipfs-bib/spool"
 	"os/exec"
 )
 
 var ErrMonolith = errors.New("monolith error")
 
 type MonolithHandler struct {
-	path string
-	args []string
+	path        string
+	args        []string
+	sourceSpool *spool.Spool
 }
 
-func NewMonolithHandler(cfg config.Config) DownloadHandler {
+func NewMonolithHandler(cfg config.Config, sourceSpool *spool.Spool) DownloadHandler {
 	if !cfg.File.Monolith.Enabled {
 		return &NoOpHandler{}
 	}
@@ -53,7 +55,7 @@ func NewMonolithHandler(cfg config.Config) DownloadHandler {
 		args = append(args, "--no-metadata")
 	}
 
-	return &MonolithHandler{path: cfg.File.Monolith.Path, args: args}
+	return &MonolithHandler{path: cfg.File.Monolith.Path, args: args, sourceSpool: sourceSpool}
 }
 
 func (s *MonolithHandler) Handle(_ context.Context, response DownloadResponse) (SourceContent, error) {
@@ -62,24 +64,60 @@ func (s *MonolithHandler) Handle(_ context.Context, response DownloadResponse) (
 	}
 
 	if _, err := exec.LookPath(s.path); err != nil {
-		return SourceContent{}, ErrNotHandled
+		return SourceContent{}, fmt.Errorf("%w: %v", ErrMonolith, err)
 	}
 
 	var args []string
 	args = append(args, s.args...)
 	args = append(args, "--base-url", response.Url.String(), "-")
 
+	page, err := response.Body.Open()
+	if err != nil {
+		return SourceContent{}, err
+	}
+
+	defer func() {
+		if err := page.Close(); err != nil {
+			logging.Verbose.Println(err)
+		}
+	}()
+
 	command := exec.Command(s.path, args...)
-	command.Stdin = bytes.NewReader(response.Body)
+	command.Stdin = page
 
-	stdout, err := command.Output()
+	stdout, err := command.StdoutPipe()
 	if err != nil {
 		return SourceContent{}, fmt.Errorf("%w: %v", ErrMonolith, err)
 	}
 
+	if err := command.Start(); err != nil {
+		return SourceContent{}, fmt.Errorf("%w: %v", ErrMonolith, err)
+	}
+
+	snapshot, err := s.sourceSpool.Write(wrappingReader{stdout, ErrMonolith}, response.MediaType())
+	if err != nil {
+		// Monolith would block writing the rest of the snapshot if we stop
+		// reading it.
+		if killErr := command.Process.Kill(); killErr != nil {
+			logging.Verbose.Println(fmt.Errorf("%w: %v", ErrMonolith, killErr))
+		}
+
+		if waitErr := command.Wait(); waitErr != nil {
+			logging.Verbose.Println(fmt.Errorf("%w: %v", ErrMonolith, waitErr))
+		}
+
+		return SourceContent{}, err
+	}
+
+	if err := command.Wait(); err != nil {
+		snapshot.Remove()
+		return SourceContent{}, fmt.Errorf("%w: %v", ErrMonolith, err)
+	}
+
 	return SourceContent{
-		Content:   stdout,
+		Content:   snapshot,
 		MediaType: response.MediaType(),
 		FileName:  config.InferFileName(&response.Url, response.MediaType(), response.Header),
+		Url:       response.Url,
 	}, nil
 }
@@ -8,20 +8,45 @@ import (
 
 type MultiHandler []DownloadHandler
 
+// Handle returns the content from the first handler which succeeds. If none
+// do, this returns why: the first ValidationError if some found content which
+// failed validation, or otherwise the first error other than ErrNotHandled.
 func (m MultiHandler) Handle(ctx context.Context, response DownloadResponse) (SourceContent, error) {
+	var validationErr, handlerErr error
+
 	for _, handler := range m {
 		content, err := handler.Handle(ctx, response)
 
 		switch {
 		case errors.Is(err, ErrNotHandled):
+			continue
+		case errors.Is(err, ErrInvalidContent):
+			logging.Verbose.Println(err)
+
+			if validationErr == nil {
+				validationErr = err
+			}
+
 			continue
 		case err != nil:
 			logging.Verbose.Println(err)
+
+			if handlerErr == nil {
+				handlerErr = err
+			}
+
 			continue
 		}
 
 		return content, nil
 	}
 
+	switch {
+	case validationErr != nil:
+		return SourceContent{}, validationErr
+	case handlerErr != nil:
+		return SourceContent{}, handlerErr
+	}
+
 	return SourceContent{}, ErrNotHandled
 }
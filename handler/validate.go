@@ -0,0 +1,415 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/frawleyskid/ipfs-bib/config"
+	"github.com/frawleyskid/ipfs-bib/logging"
+	"github.com/frawleyskid/ipfs-bib/network"
+	"github.com/frawleyskid/ipfs-bib/spool"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidContent = errors.New("content failed validation")
+
+const (
+	pdfMediaType = "application/pdf"
+
+	// The PDF header must appear in the first 1024 bytes of the file, and the
+	// trailer in the last 1024 bytes.
+	pdfHeaderWindow  = 1024
+	pdfTrailerWindow = 1024
+
+	// This is how far into the cross-reference section we look to check it's
+	// really there.
+	pdfXrefWindow = 64
+
+	// When the cross-reference offset is wrong, we scan the whole file for it
+	// in chunks of this size.
+	pdfScanChunkSize = 64 * 1024
+	pdfScanOverlap   = 8
+
+	// Interstitial pages like captchas and login walls, and parked domains,
+	// have little text, so only pages with at most this many characters of
+	// visible text are checked for interstitial and parked patterns. Otherwise,
+	// any article with a cookie banner or which mentions captchas would be
+	// rejected.
+	maxInterstitialTextLength = 2000
+)
+
+var (
+	pdfHeader          = []byte("%PDF-")
+	pdfEndOfFile       = []byte("%%EOF")
+	pdfStartXref       = []byte("startxref")
+	pdfXrefTable       = []byte("xref")
+	pdfXrefStreamRegex = regexp.MustCompile(`^\d+\s+\d+\s+obj`)
+
+	// Since the PDF header comes first, a cross-reference table always follows
+	// a line break.
+	pdfXrefTableRegex = regexp.MustCompile(`\nxref\s`)
+	pdfXrefStreamType = []byte("/XRef")
+)
+
+// These elements don't contain text which is shown to the reader.
+var hiddenTextElements = map[atom.Atom]struct{}{
+	atom.Script:   {},
+	atom.Style:    {},
+	atom.Noscript: {},
+	atom.Template: {},
+}
+
+// ValidationError is returned when a handler found content, but it isn't what
+// it claims to be, like a PDF which is actually a cookie wall.
+type ValidationError struct {
+	Url    url.URL
+	Reason string
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", ErrInvalidContent, e.Url.String(), e.Reason)
+}
+
+func (e ValidationError) Unwrap() error {
+	return ErrInvalidContent
+}
+
+// readAt reads up to `length` bytes of the file at `offset`, or fewer if the
+// file ends first.
+func readAt(file *os.File, offset int64, length int64) ([]byte, error) {
+	content := make([]byte, length)
+
+	n, err := file.ReadAt(content, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%w: %v", spool.ErrSpool, err)
+	}
+
+	return content[:n], nil
+}
+
+// containsXref returns whether the file contains a cross-reference table or
+// stream anywhere, reading it a chunk at a time.
+func containsXref(file *os.File) (bool, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return false, fmt.Errorf("%w: %v", spool.ErrSpool, err)
+	}
+
+	chunk := make([]byte, pdfScanChunkSize)
+
+	// We keep the end of the previous chunk so we find markers which straddle
+	// two chunks.
+	var overlap []byte
+
+	for {
+		n, err := io.ReadFull(file, chunk)
+
+		window := append(overlap, chunk[:n]...)
+		if pdfXrefTableRegex.Match(window) || bytes.Contains(window, pdfXrefStreamType) {
+			return true, nil
+		}
+
+		switch {
+		case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+			return false, nil
+		case err != nil:
+			return false, fmt.Errorf("%w: %v", spool.ErrSpool, err)
+		}
+
+		overlap = append(overlap[:0], window[maxInt(0, len(window)-pdfScanOverlap):]...)
+	}
+}
+
+// validatePdf checks the structure of a PDF, and returns why it's invalid or
+// an empty string if it's valid.
+func validatePdf(content *spool.File) (string, error) {
+	file, err := content.Open()
+	if err != nil {
+		return "", err
+	}
+
+	defer func() {
+		if err := file.Close(); err != nil {
+			logging.Verbose.Println(err)
+		}
+	}()
+
+	size := content.Size()
+
+	header, err := readAt(file, 0, pdfHeaderWindow)
+	if err != nil {
+		return "", err
+	}
+
+	headerIndex := bytes.Index(header, pdfHeader)
+	if headerIndex < 0 {
+		return "missing PDF header", nil
+	}
+
+	trailer, err := readAt(file, maxInt64(0, size-pdfTrailerWindow), pdfTrailerWindow)
+	if err != nil {
+		return "", err
+	}
+
+	if !bytes.Contains(trailer, pdfEndOfFile) {
+		return "missing %%EOF marker, so the file may be truncated", nil
+	}
+
+	startXrefIndex := bytes.LastIndex(trailer, pdfStartXref)
+	if startXrefIndex < 0 {
+		return "missing startxref", nil
+	}
+
+	rawOffset := strings.Fields(string(trailer[startXrefIndex+len(pdfStartXref):]))
+	if len(rawOffset) == 0 {
+		return "missing cross-reference offset", nil
+	}
+
+	offset, err := strconv.ParseInt(rawOffset[0], 10, 64)
+	if err != nil || offset < 0 {
+		return "invalid cross-reference offset", nil
+	}
+
+	// Offsets should be from the start of the file, but PDF readers accept
+	// offsets from the header too.
+	for _, xrefOffset := range []int64{offset, offset + int64(headerIndex)} {
+		if xrefOffset >= size {
+			continue
+		}
+
+		xref, err := readAt(file, xrefOffset, pdfXrefWindow)
+		if err != nil {
+			return "", err
+		}
+
+		xref = bytes.TrimLeft(xref, " \t\r\n\f\x00")
+
+		if bytes.HasPrefix(xref, pdfXrefTable) || pdfXrefStreamRegex.Match(xref) {
+			return "", nil
+		}
+	}
+
+	// PDF readers can rebuild the cross-reference table when the offset is
+	// wrong, which is common, as long as there is one.
+	hasXref, err := containsXref(file)
+	if err != nil {
+		return "", err
+	}
+
+	if hasXref {
+		return "", nil
+	}
+
+	return "cross-reference table not found", nil
+}
+
+// visibleText returns the lowercase text of a web page which is shown to the
+// reader, including its title.
+func visibleText(content []byte) (string, error) {
+	rootNode, err := html.Parse(bytes.NewReader(content))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", network.ErrUnmarshalResponse, err)
+	}
+
+	var (
+		text strings.Builder
+		walk func(node *html.Node)
+	)
+
+	walk = func(node *html.Node) {
+		if node.Type == html.ElementNode {
+			if _, hidden := hiddenTextElements[node.DataAtom]; hidden {
+				return
+			}
+		}
+
+		if node.Type == html.TextNode {
+			text.WriteString(strings.ToLower(node.Data))
+			text.WriteString(" ")
+		}
+
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+
+	walk(rootNode)
+
+	return strings.Join(strings.Fields(text.String()), " "), nil
+}
+
+// isMarkupMediaType returns whether content of this media type may look like a
+// web page when it's sniffed without being a cookie wall or error page, like
+// XHTML or plain text.
+func isMarkupMediaType(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+xml") || mediaType == "application/xml"
+}
+
+// Validator checks that content is what it claims to be before it's archived.
+type Validator struct {
+	checkPdfStructure    bool
+	interstitialPatterns []string
+	parkedPatterns       []string
+}
+
+func lowercasePatterns(patterns []string) []string {
+	lowercase := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		lowercase = append(lowercase, strings.ToLower(pattern))
+	}
+
+	return lowercase
+}
+
+func NewValidator(cfg config.Config) *Validator {
+	if !cfg.File.Validate.Enabled {
+		return nil
+	}
+
+	return &Validator{
+		checkPdfStructure:    cfg.File.Validate.PdfStructure,
+		interstitialPatterns: lowercasePatterns(cfg.File.Validate.InterstitialPatterns),
+		parkedPatterns:       lowercasePatterns(cfg.File.Validate.ParkedPatterns),
+	}
+}
+
+// reason returns why content is invalid, or an empty string if it's valid.
+func (v *Validator) reason(content SourceContent, prefix []byte) (string, error) {
+	if content.Content.Size() == 0 {
+		return "empty response", nil
+	}
+
+	sniffedMediaType, _, err := mime.ParseMediaType(http.DetectContentType(prefix))
+	if err != nil {
+		sniffedMediaType = network.DefaultMediaType
+	}
+
+	switch {
+	case content.MediaType == network.HtmlMediaType:
+		text, err := visibleText(prefix)
+		if err != nil {
+			return err.Error(), nil
+		}
+
+		if len(text) > maxInterstitialTextLength {
+			break
+		}
+
+		for _, pattern := range v.interstitialPatterns {
+			if strings.Contains(text, pattern) {
+				return fmt.Sprintf("looks like an interstitial page (contains \"%s\")", pattern), nil
+			}
+		}
+
+		// Parked domains often load their content from the parking service
+		// with JavaScript, so we check the markup as well as the text.
+		markup := strings.ToLower(string(prefix))
+
+		for _, pattern := range v.parkedPatterns {
+			if strings.Contains(text, pattern) || strings.Contains(markup, pattern) {
+				return fmt.Sprintf("looks like a parked domain (contains \"%s\")", pattern), nil
+			}
+		}
+	case sniffedMediaType == network.HtmlMediaType && !isMarkupMediaType(content.MediaType):
+		return fmt.Sprintf("expected %s, but got a web page", content.MediaType), nil
+	case content.MediaType == pdfMediaType && v.checkPdfStructure:
+		return validatePdf(content.Content)
+	case content.MediaType == pdfMediaType && !bytes.Contains(prefix[:minInt(len(prefix), pdfHeaderWindow)], pdfHeader):
+		return "missing PDF header", nil
+	}
+
+	return "", nil
+}
+
+// Validate returns a ValidationError if the content is invalid. If the server
+// didn't say what the media type of the content is, it's sniffed from the
+// content instead. Only the start of web pages is checked.
+func (v *Validator) Validate(content SourceContent) (SourceContent, error) {
+	if v == nil {
+		return content, nil
+	}
+
+	prefix, err := content.Content.Prefix(maxPageSize)
+	if err != nil {
+		return SourceContent{}, err
+	}
+
+	if content.MediaType == network.DefaultMediaType {
+		sniffedMediaType, _, err := mime.ParseMediaType(http.DetectContentType(prefix))
+		if err == nil && sniffedMediaType != network.DefaultMediaType {
+			content.MediaType = sniffedMediaType
+		}
+	}
+
+	reason, err := v.reason(content, prefix)
+	if err != nil {
+		return SourceContent{}, err
+	}
+
+	if reason != "" {
+		return SourceContent{}, &ValidationError{Url: content.Url, Reason: reason}
+	}
+
+	return content, nil
+}
+
+type validatingHandler struct {
+	handler   DownloadHandler
+	validator *Validator
+}
+
+func (h *validatingHandler) Handle(ctx context.Context, response DownloadResponse) (SourceContent, error) {
+	content, err := h.handler.Handle(ctx, response)
+	if err != nil {
+		return SourceContent{}, err
+	}
+
+	validContent, err := h.validator.Validate(content)
+	if err != nil && content.Content != response.Body {
+		content.Content.Remove()
+	}
+
+	return validContent, err
+}
+
+// Wrap returns a handler which validates the content returned by `handler`.
+func (v *Validator) Wrap(handler DownloadHandler) DownloadHandler {
+	if v == nil {
+		return handler
+	}
+
+	return &validatingHandler{handler, v}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+
+	return b
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/frawleyskid/ipfs-bib/logging"
 	"io"
 	"mime"
 	"net/http"
@@ -54,16 +55,30 @@ func responseIsOk(status int) bool {
 	return status >= 200 && status < 300
 }
 
-func NewClient(userAgent string) *HttpClient {
+func isRateLimitStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+type ClientOptions struct {
+	UserAgent   string
+	RateLimiter *RateLimiter
+	RetryPolicy RetryPolicy
+}
+
+func NewClient(options ClientOptions) *HttpClient {
 	return &HttpClient{
-		client:    &defaultClient,
-		userAgent: userAgent,
+		client:      &defaultClient,
+		userAgent:   options.UserAgent,
+		rateLimiter: options.RateLimiter,
+		retryPolicy: options.RetryPolicy,
 	}
 }
 
 type HttpClient struct {
-	client    *http.Client
-	userAgent string
+	client      *http.Client
+	userAgent   string
+	rateLimiter *RateLimiter
+	retryPolicy RetryPolicy
 }
 
 func (c *HttpClient) Request(ctx context.Context, method string, requestUrl url.URL) (*http.Response, error) {
@@ -82,14 +97,56 @@ func (c *HttpClient) RequestWithHeaders(ctx context.Context, method string, requ
 		request.Header.Set(headerName, headerValue)
 	}
 
+	for attempt := 1; ; attempt++ {
+		response, err := c.send(ctx, request.Clone(ctx), requestUrl)
+		if err == nil {
+			return response, nil
+		}
+
+		statusErr := &HttpStatusError{}
+		isStatusErr := errors.As(err, &statusErr)
+
+		if attempt >= c.retryPolicy.MaxAttempts || ctx.Err() != nil || !c.retryPolicy.isRetryable(err) {
+			if isStatusErr {
+				return nil, err
+			}
+
+			return nil, fmt.Errorf("%w: %v", ErrHttp, err)
+		}
+
+		logging.Verbose.Printf("Retrying %s \"%s\" (attempt %d of %d): %v", method, requestUrl.String(), attempt+1, c.retryPolicy.MaxAttempts, err)
+
+		if err := sleep(ctx, c.retryPolicy.delay(attempt)); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrHttp, err)
+		}
+	}
+}
+
+func (c *HttpClient) send(ctx context.Context, request *http.Request, requestUrl url.URL) (*http.Response, error) {
+	release, err := c.rateLimiter.Acquire(ctx, requestUrl.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
 	response, err := c.client.Do(request)
 	if err != nil {
-		return nil, fmt.Errorf("%w: %v", ErrHttp, err)
+		release()
+		return nil, err
+	}
+
+	response.Body = releasingBody{ReadCloser: response.Body, release: release}
+
+	if retryAfter, ok := parseRetryAfter(response.Header, time.Now()); ok && isRateLimitStatus(response.StatusCode) {
+		c.rateLimiter.Defer(requestUrl.Hostname(), retryAfter)
 	}
 
 	if !responseIsOk(response.StatusCode) {
+		if err := response.Body.Close(); err != nil {
+			return nil, err
+		}
+
 		return nil, &HttpStatusError{
-			Method:     method,
+			Method:     request.Method,
 			Url:        requestUrl,
 			StatusCode: response.StatusCode,
 			Status:     response.Status,
@@ -98,20 +155,31 @@ func (c *HttpClient) RequestWithHeaders(ctx context.Context, method string, requ
 
 	return response, nil
 }
+
 func (c *HttpClient) ResolveRedirect(ctx context.Context, sourceUrl url.URL) (url.URL, error) {
 	redirectedUrl := sourceUrl
 
-	c.client.CheckRedirect = func(request *http.Request, _ []*http.Request) error {
+	// This client is shared between goroutines, so rather than setting a
+	// redirect policy on it, we make a shallow copy which shares its transport
+	// and cookie jar.
+	redirectClient := *c.client
+	redirectClient.CheckRedirect = func(request *http.Request, _ []*http.Request) error {
 		redirectedUrl = *request.URL
 
 		return nil
 	}
 
+	redirectHttpClient := &HttpClient{
+		client:      &redirectClient,
+		userAgent:   c.userAgent,
+		rateLimiter: c.rateLimiter,
+		retryPolicy: c.retryPolicy,
+	}
+
 	// We ignore non-200 status codes because we can always just return the original URL.
-	response, err := c.Request(ctx, http.MethodGet, sourceUrl)
+	response, err := redirectHttpClient.Request(ctx, http.MethodGet, sourceUrl)
 	statusErr := &HttpStatusError{}
 	if err != nil && !errors.As(err, &statusErr) {
-		c.client.CheckRedirect = nil
 		return url.URL{}, err
 	}
 
@@ -121,8 +189,6 @@ func (c *HttpClient) ResolveRedirect(ctx context.Context, sourceUrl url.URL) (ur
 		}
 	}
 
-	c.client.CheckRedirect = nil
-
 	return redirectedUrl, nil
 }
 
@@ -150,13 +216,17 @@ func (c *HttpClient) CheckExists(ctx context.Context, sourceUrl url.URL) (bool,
 }
 
 func UnmarshalJson(response *http.Response, value interface{}) error {
-	responseBody, err := io.ReadAll(response.Body)
-	if err != nil {
-		return fmt.Errorf("%w: %v", ErrHttp, err)
+	// The body must be closed even if reading it fails, because an open body
+	// holds a connection to the host.
+	responseBody, readErr := io.ReadAll(response.Body)
+	closeErr := response.Body.Close()
+
+	if readErr != nil {
+		return fmt.Errorf("%w: %v", ErrHttp, readErr)
 	}
 
-	if err := response.Body.Close(); err != nil {
-		return fmt.Errorf("%w: %v", ErrHttp, err)
+	if closeErr != nil {
+		return fmt.Errorf("%w: %v", ErrHttp, closeErr)
 	}
 
 	if err := json.Unmarshal(responseBody, value); err != nil {
@@ -0,0 +1,218 @@
+package network
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const RetryAfterHeader = "Retry-After"
+
+type HostLimit struct {
+	RequestsPerSecond float64
+	Burst             int
+	MaxConnections    int
+}
+
+// RateLimiter schedules requests so that each host gets its own token bucket
+// and its own limit on concurrent connections. It should be shared between
+// every client that sends requests to the same hosts.
+type RateLimiter struct {
+	defaultLimit HostLimit
+	hostLimits   map[string]HostLimit
+	hosts        map[string]*hostLimiter
+	lock         sync.Mutex
+}
+
+func NewRateLimiter(defaultLimit HostLimit, hostLimits map[string]HostLimit) *RateLimiter {
+	return &RateLimiter{
+		defaultLimit: defaultLimit,
+		hostLimits:   hostLimits,
+		hosts:        make(map[string]*hostLimiter),
+	}
+}
+
+func (r *RateLimiter) forHost(hostname string) *hostLimiter {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if limiter, ok := r.hosts[hostname]; ok {
+		return limiter
+	}
+
+	limit, ok := r.hostLimits[hostname]
+	if !ok {
+		limit = r.defaultLimit
+	}
+
+	limiter := newHostLimiter(limit)
+	r.hosts[hostname] = limiter
+
+	return limiter
+}
+
+// Acquire blocks until a request can be sent to the given host. It returns a
+// function which must be called once the response body has been closed.
+func (r *RateLimiter) Acquire(ctx context.Context, hostname string) (func(), error) {
+	if r == nil {
+		return func() {}, nil
+	}
+
+	return r.forHost(hostname).acquire(ctx)
+}
+
+// Defer prevents any more requests from being sent to the given host until the
+// given time has passed. This is used to honor `Retry-After` headers.
+func (r *RateLimiter) Defer(hostname string, until time.Time) {
+	if r == nil {
+		return
+	}
+
+	r.forHost(hostname).deferUntil(until)
+}
+
+type hostLimiter struct {
+	limit        HostLimit
+	tokens       float64
+	lastRefill   time.Time
+	blockedUntil time.Time
+	connections  chan struct{}
+	lock         sync.Mutex
+}
+
+func newHostLimiter(limit HostLimit) *hostLimiter {
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+
+	var connections chan struct{}
+	if limit.MaxConnections > 0 {
+		connections = make(chan struct{}, limit.MaxConnections)
+	}
+
+	return &hostLimiter{
+		limit:       limit,
+		tokens:      float64(limit.Burst),
+		lastRefill:  time.Now(),
+		connections: connections,
+	}
+}
+
+// reserve takes a token from the bucket and returns how long the caller needs
+// to wait before sending its request. The bucket may go into debt, which is
+// how callers waiting concurrently are spaced out.
+func (l *hostLimiter) reserve(now time.Time) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var delay time.Duration
+
+	if l.blockedUntil.After(now) {
+		delay = l.blockedUntil.Sub(now)
+	}
+
+	if l.limit.RequestsPerSecond <= 0 {
+		return delay
+	}
+
+	l.tokens += now.Sub(l.lastRefill).Seconds() * l.limit.RequestsPerSecond
+	if l.tokens > float64(l.limit.Burst) {
+		l.tokens = float64(l.limit.Burst)
+	}
+
+	l.lastRefill = now
+	l.tokens--
+
+	if l.tokens < 0 {
+		tokenDelay := time.Duration(-l.tokens / l.limit.RequestsPerSecond * float64(time.Second))
+		if tokenDelay > delay {
+			delay = tokenDelay
+		}
+	}
+
+	return delay
+}
+
+func (l *hostLimiter) deferUntil(until time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if until.After(l.blockedUntil) {
+		l.blockedUntil = until
+	}
+}
+
+func (l *hostLimiter) acquire(ctx context.Context) (func(), error) {
+	if err := sleep(ctx, l.reserve(time.Now())); err != nil {
+		return nil, err
+	}
+
+	if l.connections == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case l.connections <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			<-l.connections
+		})
+	}, nil
+}
+
+func sleep(ctx context.Context, duration time.Duration) error {
+	if duration <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// parseRetryAfter parses the value of a `Retry-After` header, which may either
+// be a number of seconds or an HTTP date.
+func parseRetryAfter(header http.Header, now time.Time) (time.Time, bool) {
+	value := header.Get(RetryAfterHeader)
+	if value == "" {
+		return time.Time{}, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return now.Add(time.Duration(seconds) * time.Second), true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return date, true
+	}
+
+	return time.Time{}, false
+}
+
+// releasingBody releases a connection slot when the response body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+
+	return err
+}
@@ -0,0 +1,68 @@
+package network
+
+import (
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+)
+
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Jitter      float64
+	StatusCodes []int
+}
+
+func (p RetryPolicy) isRetryable(err error) bool {
+	statusErr := &HttpStatusError{}
+	if errors.As(err, &statusErr) {
+		for _, statusCode := range p.StatusCodes {
+			if statusErr.StatusCode == statusCode {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return isTransientError(err)
+}
+
+// delay returns how long to wait before the next attempt, where `attempt` is
+// the number of the attempt which just failed, starting at 1.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	delay := float64(p.BaseDelay) * math.Pow(2, float64(attempt-1))
+
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+
+	// Spread out retries so that concurrent requests which failed at the same
+	// time don't all retry at the same time.
+	delay *= 1 + p.Jitter*(2*rand.Float64()-1) //nolint:gosec
+
+	return time.Duration(delay)
+}
+
+func isTransientError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsTemporary {
+		return true
+	}
+
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,122 @@
+package resolver
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"github.com/frawleyskid/ipfs-bib/config"
+	"github.com/frawleyskid/ipfs-bib/logging"
+	"github.com/frawleyskid/ipfs-bib/network"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+const ContentOriginArxiv ContentOrigin = "arxiv"
+
+const (
+	arxivApiUrl    = "https://export.arxiv.org/api/query"
+	arxivPdfPrefix = "https://arxiv.org/pdf/"
+)
+
+var arxivMediaTypeHint = "application/pdf"
+
+type arxivFeedResponse struct {
+	Entries []struct {
+		Id string `xml:"id"`
+	} `xml:"entry"`
+}
+
+type ArxivResolver struct {
+	httpClient *network.HttpClient
+}
+
+func NewArxivResolver(httpClient *network.HttpClient, cfg config.Config) SourceResolver {
+	if !cfg.File.Arxiv.Enabled {
+		return &NoOpResolver{}
+	}
+
+	return &ArxivResolver{httpClient}
+}
+
+// latestVersion asks the arXiv API for the latest version of a preprint, so
+// that the archived PDF always has a versioned URL.
+func (a *ArxivResolver) latestVersion(ctx context.Context, arxivId config.ArxivId) (config.ArxivId, error) {
+	requestUrl, err := url.Parse(arxivApiUrl)
+	if err != nil {
+		logging.Error.Fatal(fmt.Errorf("%w: %v", network.ErrInvalidApiUrl, err))
+	}
+
+	requestUrl.RawQuery = url.Values{"id_list": {arxivId.Id}}.Encode()
+
+	response, err := a.httpClient.Request(ctx, http.MethodGet, *requestUrl)
+	if err != nil {
+		return config.ArxivId{}, err
+	}
+
+	// A truncated response must still be closed, or it keeps one of the
+	// connections the rate limiter allows to the arXiv API.
+	responseBody, readErr := io.ReadAll(response.Body)
+	closeErr := response.Body.Close()
+
+	if readErr != nil {
+		return config.ArxivId{}, fmt.Errorf("%w: %v", network.ErrHttp, readErr)
+	}
+
+	if closeErr != nil {
+		return config.ArxivId{}, fmt.Errorf("%w: %v", network.ErrHttp, closeErr)
+	}
+
+	var feedResponse arxivFeedResponse
+
+	if err := xml.Unmarshal(responseBody, &feedResponse); err != nil {
+		return config.ArxivId{}, fmt.Errorf("%w: %v", network.ErrUnmarshalResponse, err)
+	}
+
+	for _, entry := range feedResponse.Entries {
+		if latestId, ok := config.ParseArxivId(entry.Id); ok && latestId.Id == arxivId.Id && latestId.Version != nil {
+			return latestId, nil
+		}
+	}
+
+	return config.ArxivId{}, ErrNotResolved
+}
+
+func (*ArxivResolver) Origin() ContentOrigin {
+	return ContentOriginArxiv
+}
+
+// Resolve resolves arXiv preprints to the PDF of the version named in the
+// entry, or otherwise the latest version.
+func (a *ArxivResolver) Resolve(ctx context.Context, locator config.SourceLocator) (ResolvedLocator, error) {
+	if locator.ArxivId == nil {
+		return ResolvedLocator{}, ErrNotResolved
+	}
+
+	arxivId, ok := config.ParseArxivId(*locator.ArxivId)
+	if !ok {
+		return ResolvedLocator{}, ErrNotResolved
+	}
+
+	if arxivId.Version == nil {
+		// If we can't find the latest version, the unversioned URL still
+		// points to it.
+		if latestId, err := a.latestVersion(ctx, arxivId); err == nil {
+			arxivId = latestId
+		} else {
+			logging.Verbose.Println(err)
+		}
+	}
+
+	resolvedUrl, err := url.Parse(arxivPdfPrefix + arxivId.String())
+	if err != nil {
+		return ResolvedLocator{}, err
+	}
+
+	return ResolvedLocator{
+		ResolvedUrl:   *resolvedUrl,
+		OriginalUrl:   locator.Url,
+		Origin:        ContentOriginArxiv,
+		MediaTypeHint: &arxivMediaTypeHint,
+	}, nil
+}
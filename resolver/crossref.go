@@ -0,0 +1,282 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/frawleyskid/ipfs-bib/config"
+	"github.com/frawleyskid/ipfs-bib/logging"
+	"github.com/frawleyskid/ipfs-bib/network"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const ContentOriginCrossref ContentOrigin = "crossref"
+
+const crossrefApiUrl = "https://api.crossref.org"
+
+var crossrefMediaTypeHint = "application/pdf"
+
+// These are the values of `intended-application` on links which are meant to
+// be downloaded by anyone, rather than by Crossref members for similarity
+// checking.
+var crossrefIntendedApplications = map[string]struct{}{
+	"text-mining": {},
+	"unspecified": {},
+}
+
+// This is the `content-version` of licenses which apply to text and data
+// mining of any version of the work.
+const crossrefTdmContentVersion = "tdm"
+
+type CrossrefDate struct {
+	DateParts [][]int `json:"date-parts"`
+}
+
+// Year returns the year of the date, or 0 if it's unknown.
+func (d CrossrefDate) Year() int {
+	if len(d.DateParts) == 0 || len(d.DateParts[0]) == 0 {
+		return 0
+	}
+
+	return d.DateParts[0][0]
+}
+
+func (d CrossrefDate) Time() time.Time {
+	if len(d.DateParts) == 0 || len(d.DateParts[0]) == 0 {
+		return time.Time{}
+	}
+
+	// Missing months and days default to the first.
+	dateParts := []int{0, 1, 1}
+	copy(dateParts, d.DateParts[0])
+
+	return time.Date(dateParts[0], time.Month(dateParts[1]), dateParts[2], 0, 0, 0, 0, time.UTC)
+}
+
+type CrossrefLink struct {
+	Url                 string `json:"URL"`
+	ContentType         string `json:"content-type"`
+	ContentVersion      string `json:"content-version"`
+	IntendedApplication string `json:"intended-application"`
+}
+
+type CrossrefLicense struct {
+	Url            string       `json:"URL"`
+	Start          CrossrefDate `json:"start"`
+	ContentVersion string       `json:"content-version"`
+}
+
+type CrossrefAuthor struct {
+	Given  string `json:"given"`
+	Family string `json:"family"`
+}
+
+type CrossrefWork struct {
+	Doi            string            `json:"DOI"`
+	Title          []string          `json:"title"`
+	ContainerTitle []string          `json:"container-title"`
+	Issued         CrossrefDate      `json:"issued"`
+	Author         []CrossrefAuthor  `json:"author"`
+	Link           []CrossrefLink    `json:"link"`
+	License        []CrossrefLicense `json:"license"`
+}
+
+func (w CrossrefWork) FirstTitle() string {
+	if len(w.Title) == 0 {
+		return ""
+	}
+
+	return w.Title[0]
+}
+
+func (w CrossrefWork) FirstContainerTitle() string {
+	if len(w.ContainerTitle) == 0 {
+		return ""
+	}
+
+	return w.ContainerTitle[0]
+}
+
+// license returns the license which is in effect now and which applies to
+// the given version of the work, if there is one.
+func (w CrossrefWork) license(contentVersion string, now time.Time) *CrossrefLicense {
+	for index, license := range w.License {
+		if license.ContentVersion != contentVersion && license.ContentVersion != crossrefTdmContentVersion {
+			continue
+		}
+
+		if !license.Start.Time().After(now) {
+			return &w.License[index]
+		}
+	}
+
+	return nil
+}
+
+// CrossrefPdfLink is a link to a PDF of a work and the URL of the license it's
+// available under.
+type CrossrefPdfLink struct {
+	Url        url.URL
+	LicenseUrl string
+}
+
+// PdfLinks returns the links to PDFs of the work which are licensed for text
+// and data mining, in the order Crossref returned them.
+func (w CrossrefWork) PdfLinks(now time.Time) []CrossrefPdfLink {
+	var links []CrossrefPdfLink
+
+	for _, link := range w.Link {
+		if link.ContentType != crossrefMediaTypeHint {
+			continue
+		}
+
+		if _, ok := crossrefIntendedApplications[link.IntendedApplication]; !ok {
+			continue
+		}
+
+		license := w.license(link.ContentVersion, now)
+		if license == nil {
+			continue
+		}
+
+		linkUrl, err := url.Parse(link.Url)
+		if err != nil {
+			logging.Verbose.Println(fmt.Errorf("%w: %v", network.ErrUnmarshalResponse, err))
+			continue
+		}
+
+		links = append(links, CrossrefPdfLink{Url: *linkUrl, LicenseUrl: license.Url})
+	}
+
+	return links
+}
+
+type crossrefWorkResponse struct {
+	Message CrossrefWork `json:"message"`
+}
+
+type crossrefSearchResponse struct {
+	Message struct {
+		Items []CrossrefWork `json:"items"`
+	} `json:"message"`
+}
+
+// CrossrefClient is a client for the Crossref REST API.
+type CrossrefClient struct {
+	httpClient *network.HttpClient
+	email      *string
+}
+
+func NewCrossrefClient(httpClient *network.HttpClient, cfg config.Config) *CrossrefClient {
+	return &CrossrefClient{httpClient, cfg.File.Crossref.MaybeEmail()}
+}
+
+// apiUrl returns the URL of an API endpoint. Passing an email address puts
+// requests in the "polite" pool, which is more reliable.
+func (c *CrossrefClient) apiUrl(path string, query url.Values) url.URL {
+	if query == nil {
+		query = url.Values{}
+	}
+
+	if c.email != nil {
+		query.Set("mailto", *c.email)
+	}
+
+	requestUrl, err := url.Parse(fmt.Sprintf("%s/%s", crossrefApiUrl, path))
+	if err != nil {
+		logging.Error.Fatal(fmt.Errorf("%w: %v", network.ErrInvalidApiUrl, err))
+	}
+
+	requestUrl.RawQuery = query.Encode()
+
+	return *requestUrl
+}
+
+// Work returns the metadata for a DOI, or ErrNotResolved if Crossref doesn't
+// know about it.
+func (c *CrossrefClient) Work(ctx context.Context, doi string) (CrossrefWork, error) {
+	response, err := c.httpClient.Request(ctx, http.MethodGet, c.apiUrl(fmt.Sprintf("works/%s", url.PathEscape(doi)), nil))
+
+	statusErr := &network.HttpStatusError{}
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+		return CrossrefWork{}, ErrNotResolved
+	} else if err != nil {
+		return CrossrefWork{}, err
+	}
+
+	var workResponse crossrefWorkResponse
+
+	if err := network.UnmarshalJson(response, &workResponse); err != nil {
+		return CrossrefWork{}, err
+	}
+
+	return workResponse.Message, nil
+}
+
+// Search returns the works which best match a bibliographic reference, like a
+// title and author, from best to worst.
+func (c *CrossrefClient) Search(ctx context.Context, reference string, rows int) ([]CrossrefWork, error) {
+	query := url.Values{
+		"query.bibliographic": {reference},
+		"rows":                {fmt.Sprint(rows)},
+	}
+
+	response, err := c.httpClient.Request(ctx, http.MethodGet, c.apiUrl("works", query))
+	if err != nil {
+		return nil, err
+	}
+
+	var searchResponse crossrefSearchResponse
+
+	if err := network.UnmarshalJson(response, &searchResponse); err != nil {
+		return nil, err
+	}
+
+	return searchResponse.Message.Items, nil
+}
+
+// CrossrefResolver resolves DOIs to the PDF links which publishers deposit
+// with Crossref for text and data mining.
+type CrossrefResolver struct {
+	client *CrossrefClient
+}
+
+func NewCrossrefResolver(httpClient *network.HttpClient, cfg config.Config) SourceResolver {
+	if !cfg.File.Crossref.Enabled {
+		return &NoOpResolver{}
+	}
+
+	return &CrossrefResolver{NewCrossrefClient(httpClient, cfg)}
+}
+
+func (*CrossrefResolver) Origin() ContentOrigin {
+	return ContentOriginCrossref
+}
+
+func (r *CrossrefResolver) Resolve(ctx context.Context, locator config.SourceLocator) (ResolvedLocator, error) {
+	if locator.Doi == nil {
+		return ResolvedLocator{}, ErrNotResolved
+	}
+
+	work, err := r.client.Work(ctx, *locator.Doi)
+	if err != nil {
+		return ResolvedLocator{}, err
+	}
+
+	links := work.PdfLinks(time.Now())
+	if len(links) == 0 {
+		return ResolvedLocator{}, ErrNotResolved
+	}
+
+	license := config.NormalizeLicense(links[0].LicenseUrl)
+
+	return ResolvedLocator{
+		ResolvedUrl:   links[0].Url,
+		OriginalUrl:   locator.Url,
+		Origin:        ContentOriginCrossref,
+		MediaTypeHint: &crossrefMediaTypeHint,
+		License:       &license,
+	}, nil
+}
@@ -7,6 +7,31 @@ import (
 	"github.com/frawleyskid/ipfs-bib/logging"
 )
 
+// EachResolver is a resolver which can find more than one locator for a
+// source, so that if a source can't be downloaded from one, the next one is
+// tried.
+type EachResolver interface {
+	// ResolveEach passes each locator to `try` in order until it succeeds.
+	// Later locators aren't looked up unless they're needed. Errors looking up
+	// locators are passed to `fail` with the origin of the resolver, if
+	// known. This returns ErrNotResolved if `try` never succeeds.
+	ResolveEach(ctx context.Context, locator config.SourceLocator, try func(ResolvedLocator) error, fail func(ContentOrigin, error)) error
+}
+
+// originResolver is a resolver whose sources all have the same origin, so
+// that when it fails, we can say which resolver it was.
+type originResolver interface {
+	Origin() ContentOrigin
+}
+
+func resolverOrigin(resolver SourceResolver) ContentOrigin {
+	if originResolver, ok := resolver.(originResolver); ok {
+		return originResolver.Origin()
+	}
+
+	return ""
+}
+
 type MultiResolver []SourceResolver
 
 func (m MultiResolver) Resolve(ctx context.Context, locator config.SourceLocator) (ResolvedLocator, error) {
@@ -26,3 +51,49 @@ func (m MultiResolver) Resolve(ctx context.Context, locator config.SourceLocator
 
 	return ResolvedLocator{}, ErrNotResolved
 }
+
+// ResolveEach tries the locators from each resolver in order.
+func (m MultiResolver) ResolveEach(ctx context.Context, locator config.SourceLocator, try func(ResolvedLocator) error, fail func(ContentOrigin, error)) error {
+	for _, resolver := range m {
+		if err := ResolveEach(ctx, resolver, locator, try, fail); err == nil {
+			return nil
+		}
+	}
+
+	return ErrNotResolved
+}
+
+// tryLocator calls `try` and logs why it failed. If `try` returns
+// ErrNotResolved, the source was found but wasn't usable, which isn't worth
+// logging.
+func tryLocator(try func(ResolvedLocator) error, resolvedLocator ResolvedLocator) error {
+	if err := try(resolvedLocator); errors.Is(err, ErrNotResolved) {
+		return err
+	} else if err != nil {
+		logging.Verbose.Println(err)
+		return ErrNotResolved
+	}
+
+	return nil
+}
+
+// ResolveEach is like EachResolver.ResolveEach, but accepts any resolver.
+// Resolvers which only find one locator are tried once.
+func ResolveEach(ctx context.Context, resolver SourceResolver, locator config.SourceLocator, try func(ResolvedLocator) error, fail func(ContentOrigin, error)) error {
+	if eachResolver, ok := resolver.(EachResolver); ok {
+		return eachResolver.ResolveEach(ctx, locator, try, fail)
+	}
+
+	resolvedLocator, err := resolver.Resolve(ctx, locator)
+
+	switch {
+	case errors.Is(err, ErrNotResolved):
+		return err
+	case err != nil:
+		logging.Verbose.Println(err)
+		fail(resolverOrigin(resolver), err)
+		return ErrNotResolved
+	}
+
+	return tryLocator(try, resolvedLocator)
+}
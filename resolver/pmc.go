@@ -0,0 +1,228 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"github.com/frawleyskid/ipfs-bib/config"
+	"github.com/frawleyskid/ipfs-bib/logging"
+	"github.com/frawleyskid/ipfs-bib/network"
+	"net/http"
+	"net/url"
+)
+
+const ContentOriginPmc ContentOrigin = "pmc"
+
+const (
+	idConverterApiUrl = "https://www.ncbi.nlm.nih.gov/pmc/utils/idconv/v1.0/"
+	europePmcApiUrl   = "https://www.ebi.ac.uk/europepmc/webservices/rest/search"
+	europePmcPdfUrl   = "https://europepmc.org/articles/%s?pdf=render"
+	idConverterTool   = "ipfs-bib"
+)
+
+const (
+	europePmcSite     = "Europe_PMC"
+	pubmedCentralSite = "PubMedCentral"
+)
+
+var pmcMediaTypeHint = "application/pdf"
+
+// These are the `availabilityCode` values of full-text links which anyone can
+// download.
+var europePmcFreeAvailability = map[string]struct{}{
+	"OA": {},
+	"F":  {},
+}
+
+type idConverterResponse struct {
+	Records []struct {
+		Pmcid string `json:"pmcid"`
+	} `json:"records"`
+}
+
+type europePmcFullTextUrl struct {
+	AvailabilityCode string `json:"availabilityCode"`
+	DocumentStyle    string `json:"documentStyle"`
+	Site             string `json:"site"`
+	Url              string `json:"url"`
+}
+
+type europePmcResult struct {
+	Pmcid           string `json:"pmcid"`
+	IsOpenAccess    string `json:"isOpenAccess"`
+	FullTextUrlList struct {
+		FullTextUrl []europePmcFullTextUrl `json:"fullTextUrl"`
+	} `json:"fullTextUrlList"`
+}
+
+type europePmcResponse struct {
+	ResultList struct {
+		Result []europePmcResult `json:"result"`
+	} `json:"resultList"`
+}
+
+// PmcResolver resolves entries with a PMID, PMCID or DOI to open access PDFs
+// in PubMed Central or Europe PMC.
+type PmcResolver struct {
+	httpClient    *network.HttpClient
+	email         *string
+	preferredSite string
+}
+
+func NewPmcResolver(httpClient *network.HttpClient, cfg config.Config) (SourceResolver, error) {
+	if !cfg.File.Pmc.Enabled {
+		return &NoOpResolver{}, nil
+	}
+
+	preferPmc, err := cfg.File.Pmc.PreferPmc()
+	if err != nil {
+		return nil, err
+	}
+
+	preferredSite := europePmcSite
+	if preferPmc {
+		preferredSite = pubmedCentralSite
+	}
+
+	return &PmcResolver{httpClient, cfg.File.Pmc.MaybeEmail(), preferredSite}, nil
+}
+
+func pmcApiUrl(rawUrl string, query url.Values) url.URL {
+	requestUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		logging.Error.Fatal(fmt.Errorf("%w: %v", network.ErrInvalidApiUrl, err))
+	}
+
+	requestUrl.RawQuery = query.Encode()
+
+	return *requestUrl
+}
+
+// convertId uses the NCBI ID converter to find the PMCID for a PMID or DOI.
+func (p *PmcResolver) convertId(ctx context.Context, id string) (string, error) {
+	query := url.Values{
+		"ids":    {id},
+		"format": {"json"},
+		"tool":   {idConverterTool},
+	}
+
+	if p.email != nil {
+		query.Set("email", *p.email)
+	}
+
+	response, err := p.httpClient.Request(ctx, http.MethodGet, pmcApiUrl(idConverterApiUrl, query))
+	if err != nil {
+		return "", err
+	}
+
+	var converterResponse idConverterResponse
+
+	if err := network.UnmarshalJson(response, &converterResponse); err != nil {
+		return "", err
+	}
+
+	for _, record := range converterResponse.Records {
+		if record.Pmcid != "" {
+			return record.Pmcid, nil
+		}
+	}
+
+	return "", ErrNotResolved
+}
+
+func (p *PmcResolver) locatePmcid(ctx context.Context, locator config.SourceLocator) (string, error) {
+	switch {
+	case locator.Pmcid != nil:
+		return *locator.Pmcid, nil
+	case locator.Pmid != nil:
+		return p.convertId(ctx, *locator.Pmid)
+	case locator.Doi != nil:
+		return p.convertId(ctx, *locator.Doi)
+	default:
+		return "", ErrNotResolved
+	}
+}
+
+// pdfUrl asks Europe PMC whether an article is open access, and returns the
+// URL of its PDF on the preferred site if there is one.
+func (p *PmcResolver) pdfUrl(ctx context.Context, pmcid string) (string, error) {
+	query := url.Values{
+		"query":      {fmt.Sprintf("PMCID:%s", pmcid)},
+		"resultType": {"core"},
+		"format":     {"json"},
+	}
+
+	response, err := p.httpClient.Request(ctx, http.MethodGet, pmcApiUrl(europePmcApiUrl, query))
+	if err != nil {
+		return "", err
+	}
+
+	var searchResponse europePmcResponse
+
+	if err := network.UnmarshalJson(response, &searchResponse); err != nil {
+		return "", err
+	}
+
+	for _, result := range searchResponse.ResultList.Result {
+		if result.Pmcid != pmcid || result.IsOpenAccess != "Y" {
+			continue
+		}
+
+		var pdfUrl string
+
+		for _, fullTextUrl := range result.FullTextUrlList.FullTextUrl {
+			if fullTextUrl.DocumentStyle != "pdf" {
+				continue
+			}
+
+			if _, isFree := europePmcFreeAvailability[fullTextUrl.AvailabilityCode]; !isFree {
+				continue
+			}
+
+			if fullTextUrl.Site == p.preferredSite {
+				return fullTextUrl.Url, nil
+			}
+
+			if pdfUrl == "" {
+				pdfUrl = fullTextUrl.Url
+			}
+		}
+
+		// Europe PMC can render a PDF for every open access article, even if
+		// it doesn't list one.
+		if pdfUrl == "" {
+			pdfUrl = fmt.Sprintf(europePmcPdfUrl, pmcid)
+		}
+
+		return pdfUrl, nil
+	}
+
+	return "", ErrNotResolved
+}
+
+func (*PmcResolver) Origin() ContentOrigin {
+	return ContentOriginPmc
+}
+
+func (p *PmcResolver) Resolve(ctx context.Context, locator config.SourceLocator) (ResolvedLocator, error) {
+	pmcid, err := p.locatePmcid(ctx, locator)
+	if err != nil {
+		return ResolvedLocator{}, err
+	}
+
+	rawPdfUrl, err := p.pdfUrl(ctx, pmcid)
+	if err != nil {
+		return ResolvedLocator{}, err
+	}
+
+	resolvedUrl, err := url.Parse(rawPdfUrl)
+	if err != nil {
+		return ResolvedLocator{}, fmt.Errorf("%w: %v", network.ErrUnmarshalResponse, err)
+	}
+
+	return ResolvedLocator{
+		ResolvedUrl:   *resolvedUrl,
+		OriginalUrl:   locator.Url,
+		Origin:        ContentOriginPmc,
+		MediaTypeHint: &pmcMediaTypeHint,
+	}, nil
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/frawleyskid/ipfs-bib/config"
 	"github.com/frawleyskid/ipfs-bib/network"
 	"net/url"
+	"time"
 )
 
 var ErrNotResolved = errors.New("content not resolved")
@@ -19,6 +20,15 @@ type ResolvedLocator struct {
 	ResolvedUrl   url.URL
 	Origin        ContentOrigin
 	MediaTypeHint *string
+
+	// If this is a capture of a web page, like in the Wayback Machine, this is
+	// when it was captured.
+	CaptureTime *time.Time
+
+	// The license of the content, as normalized by config.NormalizeLicense,
+	// and which version of the work it is (e.g. `published`), if known.
+	License *string
+	Version *string
 }
 
 type SourceResolver interface {
@@ -27,6 +37,10 @@ type SourceResolver interface {
 
 type DirectResolver struct{}
 
+func (DirectResolver) Origin() ContentOrigin {
+	return ContentOriginUrl
+}
+
 func (DirectResolver) Resolve(_ context.Context, locator config.SourceLocator) (ResolvedLocator, error) {
 	return ResolvedLocator{
 		ResolvedUrl:   locator.Url,
@@ -42,15 +56,29 @@ func (NoOpResolver) Resolve(_ context.Context, _ config.SourceLocator) (Resolved
 	return ResolvedLocator{}, ErrNotResolved
 }
 
-func FromConfig(cfg config.Config) (SourceResolver, error) {
-	userResolver, err := NewUserResolver(network.NewClient(cfg.File.Archive.UserAgent), cfg.File.Resolvers)
+func FromConfig(cfg config.Config, httpClient *network.HttpClient) (SourceResolver, error) {
+	userResolver, err := NewUserResolver(httpClient, cfg.File.Resolvers)
+	if err != nil {
+		return nil, err
+	}
+
+	unpaywallResolver, err := NewUnpaywallResolver(httpClient, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	pmcResolver, err := NewPmcResolver(httpClient, cfg)
 	if err != nil {
 		return nil, err
 	}
 
 	return MultiResolver{
-		NewUnpaywallResolver(network.NewClient(cfg.File.Archive.UserAgent), cfg),
+		NewArxivResolver(httpClient, cfg),
+		unpaywallResolver,
+		pmcResolver,
+		NewCrossrefResolver(httpClient, cfg),
 		userResolver,
 		DirectResolver{},
+		NewWaybackResolver(httpClient, cfg),
 	}, nil
 }
@@ -8,39 +8,81 @@ import (
 	"github.com/frawleyskid/ipfs-bib/network"
 	"net/http"
 	"net/url"
+	"sort"
+	"strings"
 )
 
 const ContentOriginUnpaywall ContentOrigin = "unpaywall"
 
+// Unpaywall names versions like `publishedVersion`, but we call them
+// `published` in the config file and output.
+const unpaywallVersionSuffix = "Version"
+
 var unpaywallMediaTypeHint = "application/pdf"
 
 type unpaywallLocationResponse struct {
-	Url string `json:"url_for_pdf"`
+	PdfUrl   string  `json:"url_for_pdf"`
+	Url      string  `json:"url"`
+	HostType string  `json:"host_type"`
+	Version  string  `json:"version"`
+	License  *string `json:"license"`
 }
 
 type unpaywallResponse struct {
-	BestLocation unpaywallLocationResponse `json:"best_oa_location"`
+	Locations []unpaywallLocationResponse `json:"oa_locations"`
 }
 
 type UnpaywallResolver struct {
 	httpClient *network.HttpClient
 	auth       string
+	hostTypes  map[string]int
+	versions   map[string]int
 }
 
-func NewUnpaywallResolver(httpClient *network.HttpClient, cfg config.Config) SourceResolver {
+func NewUnpaywallResolver(httpClient *network.HttpClient, cfg config.Config) (SourceResolver, error) {
 	if !cfg.File.Unpaywall.Enabled || cfg.File.Unpaywall.Email == "" {
-		return &NoOpResolver{}
+		return &NoOpResolver{}, nil
+	}
+
+	if err := cfg.File.Unpaywall.Validate(); err != nil {
+		return nil, err
+	}
+
+	// These map each host type and version to its position in the preference
+	// order.
+	hostTypes := make(map[string]int, len(cfg.File.Unpaywall.HostTypes))
+	for index, hostType := range cfg.File.Unpaywall.HostTypes {
+		hostTypes[hostType] = index
+	}
+
+	versions := make(map[string]int, len(cfg.File.Unpaywall.Versions))
+	for index, version := range cfg.File.Unpaywall.Versions {
+		versions[version] = index
 	}
 
-	return &UnpaywallResolver{httpClient, cfg.File.Unpaywall.Email}
+	return &UnpaywallResolver{httpClient, cfg.File.Unpaywall.Email, hostTypes, versions}, nil
 }
 
-func (u *UnpaywallResolver) Resolve(ctx context.Context, locator config.SourceLocator) (ResolvedLocator, error) {
-	if locator.Doi == nil {
-		return ResolvedLocator{}, ErrNotResolved
+// preference returns the position of a host type or version in the
+// preference order, and whether it's allowed. If no preferences are
+// configured, everything is allowed and ranked equally, which keeps the order
+// Unpaywall returned them in.
+func preference(preferences map[string]int, value string) (int, bool) {
+	if len(preferences) == 0 {
+		return 0, true
 	}
 
-	rawUrl := fmt.Sprintf("https://api.unpaywall.org/v2/%s?email=%s", url.PathEscape(*locator.Doi), url.QueryEscape(u.auth))
+	index, ok := preferences[value]
+
+	return index, ok
+}
+
+// locations returns the open access locations of a DOI which have an allowed
+// host type and version, sorted by version and then host type in order of
+// preference. Ties keep the order Unpaywall returned them in, which puts the
+// best location first.
+func (u *UnpaywallResolver) locations(ctx context.Context, doi string) ([]unpaywallLocationResponse, error) {
+	rawUrl := fmt.Sprintf("https://api.unpaywall.org/v2/%s?email=%s", url.PathEscape(doi), url.QueryEscape(u.auth))
 
 	requestUrl, err := url.Parse(rawUrl)
 	if err != nil {
@@ -49,32 +91,122 @@ func (u *UnpaywallResolver) Resolve(ctx context.Context, locator config.SourceLo
 
 	response, err := u.httpClient.Request(ctx, http.MethodGet, *requestUrl)
 	if err != nil {
-		return ResolvedLocator{}, err
+		return nil, err
 	}
 
 	apiResponse := unpaywallResponse{}
 
 	if err := network.UnmarshalJson(response, &apiResponse); err != nil {
-		return ResolvedLocator{}, err
+		return nil, err
 	}
 
-	if err := response.Body.Close(); err != nil {
-		return ResolvedLocator{}, err
+	locations := make([]unpaywallLocationResponse, 0, len(apiResponse.Locations))
+
+	for _, location := range apiResponse.Locations {
+		location.Version = strings.TrimSuffix(location.Version, unpaywallVersionSuffix)
+
+		_, hasHostType := preference(u.hostTypes, location.HostType)
+		_, hasVersion := preference(u.versions, location.Version)
+
+		if hasHostType && hasVersion && (location.PdfUrl != "" || location.Url != "") {
+			locations = append(locations, location)
+		}
 	}
 
-	if apiResponse.BestLocation.Url == "" {
-		return ResolvedLocator{}, ErrNotResolved
+	sort.SliceStable(locations, func(i, j int) bool {
+		versionI, _ := preference(u.versions, locations[i].Version)
+		versionJ, _ := preference(u.versions, locations[j].Version)
+
+		if versionI != versionJ {
+			return versionI < versionJ
+		}
+
+		hostTypeI, _ := preference(u.hostTypes, locations[i].HostType)
+		hostTypeJ, _ := preference(u.hostTypes, locations[j].HostType)
+
+		return hostTypeI < hostTypeJ
+	})
+
+	return locations, nil
+}
+
+func (u *UnpaywallResolver) resolveLocation(locator config.SourceLocator, location unpaywallLocationResponse) (ResolvedLocator, error) {
+	// If there's no link to a PDF, the landing page may still embed one.
+	rawUrl, mediaTypeHint := location.PdfUrl, &unpaywallMediaTypeHint
+	if rawUrl == "" {
+		rawUrl, mediaTypeHint = location.Url, nil
 	}
 
-	resolvedUrl, err := url.Parse(apiResponse.BestLocation.Url)
+	resolvedUrl, err := url.Parse(rawUrl)
 	if err != nil {
 		return ResolvedLocator{}, fmt.Errorf("%w: %v", network.ErrUnmarshalResponse, err)
 	}
 
+	version := location.Version
+
+	var license *string
+	if location.License != nil {
+		normalizedLicense := config.NormalizeLicense(*location.License)
+		license = &normalizedLicense
+	}
+
 	return ResolvedLocator{
 		ResolvedUrl:   *resolvedUrl,
 		OriginalUrl:   locator.Url,
 		Origin:        ContentOriginUnpaywall,
-		MediaTypeHint: &unpaywallMediaTypeHint,
+		MediaTypeHint: mediaTypeHint,
+		License:       license,
+		Version:       &version,
 	}, nil
 }
+
+func (*UnpaywallResolver) Origin() ContentOrigin {
+	return ContentOriginUnpaywall
+}
+
+func (u *UnpaywallResolver) Resolve(ctx context.Context, locator config.SourceLocator) (ResolvedLocator, error) {
+	if locator.Doi == nil {
+		return ResolvedLocator{}, ErrNotResolved
+	}
+
+	locations, err := u.locations(ctx, *locator.Doi)
+	if err != nil {
+		return ResolvedLocator{}, err
+	}
+
+	if len(locations) == 0 {
+		return ResolvedLocator{}, ErrNotResolved
+	}
+
+	return u.resolveLocation(locator, locations[0])
+}
+
+// ResolveEach tries each open access location in order of preference, so that
+// if one of them is broken, the next one is used.
+func (u *UnpaywallResolver) ResolveEach(ctx context.Context, locator config.SourceLocator, try func(ResolvedLocator) error, fail func(ContentOrigin, error)) error {
+	if locator.Doi == nil {
+		return ErrNotResolved
+	}
+
+	locations, err := u.locations(ctx, *locator.Doi)
+	if err != nil {
+		logging.Verbose.Println(err)
+		fail(ContentOriginUnpaywall, err)
+		return ErrNotResolved
+	}
+
+	for _, location := range locations {
+		resolvedLocator, err := u.resolveLocation(locator, location)
+		if err != nil {
+			logging.Verbose.Println(err)
+			fail(ContentOriginUnpaywall, err)
+			continue
+		}
+
+		if err := tryLocator(try, resolvedLocator); err == nil {
+			return nil
+		}
+	}
+
+	return ErrNotResolved
+}
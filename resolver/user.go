@@ -57,6 +57,10 @@ func NewUserResolver(httpClient *network.HttpClient, cfg []config.Resolver) (Sou
 	return &UserResolver{httpClient, rules}, nil
 }
 
+func (*UserResolver) Origin() ContentOrigin {
+	return ContentOriginUser
+}
+
 func (u *UserResolver) Resolve(ctx context.Context, locator config.SourceLocator) (ResolvedLocator, error) {
 	for _, rule := range u.rules {
 		templateInput := config.NewProxySchemeInput(locator, rule.Filter)
@@ -0,0 +1,105 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"github.com/frawleyskid/ipfs-bib/config"
+	"github.com/frawleyskid/ipfs-bib/logging"
+	"github.com/frawleyskid/ipfs-bib/network"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const ContentOriginWayback ContentOrigin = "wayback"
+
+const (
+	waybackApiUrl = "https://archive.org/wayback/available"
+
+	// The `id_` flag returns the captured content as it was originally
+	// served, without the Wayback Machine toolbar or rewritten links.
+	waybackRawUrl = "https://web.archive.org/web/%sid_/%s"
+
+	waybackTimestampLayout = "20060102150405"
+)
+
+type waybackSnapshotResponse struct {
+	Available bool   `json:"available"`
+	Status    string `json:"status"`
+	Timestamp string `json:"timestamp"`
+}
+
+type waybackResponse struct {
+	ArchivedSnapshots struct {
+		Closest *waybackSnapshotResponse `json:"closest"`
+	} `json:"archived_snapshots"`
+}
+
+// WaybackResolver resolves URLs to captures of them in the Internet Archive's
+// Wayback Machine. This should be the last resolver, because it's only useful
+// when the URL is dead.
+type WaybackResolver struct {
+	httpClient *network.HttpClient
+	useUrlDate bool
+}
+
+func NewWaybackResolver(httpClient *network.HttpClient, cfg config.Config) SourceResolver {
+	if !cfg.File.Wayback.Enabled {
+		return &NoOpResolver{}
+	}
+
+	return &WaybackResolver{httpClient, cfg.File.Wayback.UseUrlDate}
+}
+
+func (*WaybackResolver) Origin() ContentOrigin {
+	return ContentOriginWayback
+}
+
+func (w *WaybackResolver) Resolve(ctx context.Context, locator config.SourceLocator) (ResolvedLocator, error) {
+	query := url.Values{"url": {locator.Url.String()}}
+
+	if w.useUrlDate && locator.UrlDate != nil {
+		query.Set("timestamp", locator.UrlDate.Format(waybackTimestampLayout))
+	}
+
+	requestUrl, err := url.Parse(waybackApiUrl)
+	if err != nil {
+		logging.Error.Fatal(fmt.Errorf("%w: %v", network.ErrInvalidApiUrl, err))
+	}
+
+	requestUrl.RawQuery = query.Encode()
+
+	response, err := w.httpClient.Request(ctx, http.MethodGet, *requestUrl)
+	if err != nil {
+		return ResolvedLocator{}, err
+	}
+
+	var apiResponse waybackResponse
+
+	if err := network.UnmarshalJson(response, &apiResponse); err != nil {
+		return ResolvedLocator{}, err
+	}
+
+	snapshot := apiResponse.ArchivedSnapshots.Closest
+	if snapshot == nil || !snapshot.Available || snapshot.Status != fmt.Sprint(http.StatusOK) {
+		return ResolvedLocator{}, ErrNotResolved
+	}
+
+	captureTime, err := time.Parse(waybackTimestampLayout, snapshot.Timestamp)
+	if err != nil {
+		return ResolvedLocator{}, fmt.Errorf("%w: %v", network.ErrUnmarshalResponse, err)
+	}
+
+	resolvedUrl, err := url.Parse(fmt.Sprintf(waybackRawUrl, snapshot.Timestamp, locator.Url.String()))
+	if err != nil {
+		return ResolvedLocator{}, fmt.Errorf("%w: %v", network.ErrUnmarshalResponse, err)
+	}
+
+	return ResolvedLocator{
+		ResolvedUrl:   *resolvedUrl,
+		OriginalUrl:   locator.Url,
+		Origin:        ContentOriginWayback,
+		MediaTypeHint: nil,
+		CaptureTime:   &captureTime,
+	}, nil
+}
@@ -0,0 +1,203 @@
+package spool
+
+import (
+	"errors"
+	"fmt"
+	"github.com/frawleyskid/ipfs-bib/config"
+	"github.com/frawleyskid/ipfs-bib/logging"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const spoolDirPattern = "ipfs-bib-*"
+
+var (
+	ErrSpool    = errors.New("spool error")
+	ErrTooLarge = errors.New("file is larger than the maximum file size")
+)
+
+// Spool stores the content of sources in temporary files until they're
+// archived, so that large files don't need to be held in memory. It also
+// enforces the maximum file size of sources.
+type Spool struct {
+	dir                    string
+	maxFileSize            int64
+	maxFileSizeByMediaType map[string]int64
+}
+
+func New(parentDir string, maxFileSize int64, maxFileSizeByMediaType map[string]int64) (*Spool, error) {
+	dir, err := ioutil.TempDir(parentDir, spoolDirPattern)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSpool, err)
+	}
+
+	return &Spool{dir, maxFileSize, maxFileSizeByMediaType}, nil
+}
+
+func FromConfig(cfg config.Config) (*Spool, error) {
+	maxFileSizeByMediaType := make(map[string]int64, len(cfg.File.Limit.MediaTypes))
+	for _, mediaTypeLimit := range cfg.File.Limit.MediaTypes {
+		maxFileSizeByMediaType[strings.ToLower(mediaTypeLimit.MediaType)] = mediaTypeLimit.MaxFileSize
+	}
+
+	return New(cfg.File.Spool.Path, cfg.File.Limit.MaxFileSize, maxFileSizeByMediaType)
+}
+
+// maxFileSizeFor returns the maximum size of a source with the given media
+// type, or 0 if there is no limit.
+func (s *Spool) maxFileSizeFor(mediaType string) int64 {
+	if maxFileSize, ok := s.maxFileSizeByMediaType[strings.ToLower(mediaType)]; ok {
+		return maxFileSize
+	}
+
+	return s.maxFileSize
+}
+
+// CheckSize returns ErrTooLarge if a source with the given size and media
+// type is larger than the maximum file size.
+func (s *Spool) CheckSize(size int64, mediaType string) error {
+	if maxFileSize := s.maxFileSizeFor(mediaType); maxFileSize > 0 && size > maxFileSize {
+		return fmt.Errorf("%w: more than %d bytes", ErrTooLarge, maxFileSize)
+	}
+
+	return nil
+}
+
+// trackingReader remembers the last error from reading, so that it can be
+// told apart from an error writing.
+type trackingReader struct {
+	reader io.Reader
+	err    error
+}
+
+func (r *trackingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		r.err = err
+	}
+
+	return n, err
+}
+
+// Write copies `reader` into a new file in the spool. If it's larger than the
+// maximum file size for its media type, this stops reading and returns
+// ErrTooLarge. Errors from `reader` are returned as-is.
+func (s *Spool) Write(reader io.Reader, mediaType string) (*File, error) {
+	tempFile, err := ioutil.TempFile(s.dir, "")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSpool, err)
+	}
+
+	file := &File{path: tempFile.Name(), temporary: true}
+
+	source := &trackingReader{reader: reader}
+
+	// We read one byte past the maximum file size to know whether there's
+	// more.
+	var limitedSource io.Reader = source
+	if maxFileSize := s.maxFileSizeFor(mediaType); maxFileSize > 0 {
+		limitedSource = io.LimitReader(source, maxFileSize+1)
+	}
+
+	size, copyErr := io.Copy(tempFile, limitedSource)
+	closeErr := tempFile.Close()
+
+	switch {
+	case source.err != nil:
+		file.Remove()
+		return nil, source.err
+	case copyErr != nil:
+		file.Remove()
+		return nil, fmt.Errorf("%w: %v", ErrSpool, copyErr)
+	case closeErr != nil:
+		file.Remove()
+		return nil, fmt.Errorf("%w: %v", ErrSpool, closeErr)
+	}
+
+	if err := s.CheckSize(size, mediaType); err != nil {
+		file.Remove()
+		return nil, err
+	}
+
+	file.size = size
+
+	return file, nil
+}
+
+// Borrow returns a file which is read where it is rather than copied into the
+// spool, like a local file. Errors from os.Stat are returned as-is, and
+// removing the file does nothing.
+func (s *Spool) Borrow(filePath string, mediaType string) (*File, error) {
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.CheckSize(fileInfo.Size(), mediaType); err != nil {
+		return nil, err
+	}
+
+	return &File{path: filePath, size: fileInfo.Size()}, nil
+}
+
+// Close removes every file in the spool.
+func (s *Spool) Close() error {
+	if err := os.RemoveAll(s.dir); err != nil {
+		return fmt.Errorf("%w: %v", ErrSpool, err)
+	}
+
+	return nil
+}
+
+// File is the content of a source, stored on disk.
+type File struct {
+	path      string
+	size      int64
+	temporary bool
+}
+
+func (f *File) Size() int64 {
+	return f.size
+}
+
+func (f *File) Open() (*os.File, error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSpool, err)
+	}
+
+	return file, nil
+}
+
+// Prefix reads at most the first `n` bytes of the file.
+func (f *File) Prefix(n int64) ([]byte, error) {
+	file, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := io.ReadAll(io.LimitReader(file, n))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSpool, err)
+	}
+
+	if err := file.Close(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSpool, err)
+	}
+
+	return content, nil
+}
+
+// Remove deletes the file once it's no longer needed, unless it was borrowed.
+// A nil *File is valid.
+func (f *File) Remove() {
+	if f == nil || !f.temporary {
+		return
+	}
+
+	if err := os.Remove(f.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logging.Verbose.Println(fmt.Errorf("%w: %v", ErrSpool, err))
+	}
+}
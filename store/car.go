@@ -73,13 +73,13 @@ type CarSourceStore struct {
 	carv2   bool
 }
 
-func NewCarSourceStore(ctx context.Context, carPath string, carv2 bool) (*CarSourceStore, error) {
+func NewCarSourceStore(ctx context.Context, carPath string, carv2 bool, previousRoot *string) (*CarSourceStore, error) {
 	service, err := NewLocalService()
 	if err != nil {
 		return nil, err
 	}
 
-	store, err := newDagSourceStore(ctx, service)
+	store, err := newDagSourceStore(ctx, service, previousRoot)
 	if err != nil {
 		return nil, err
 	}
@@ -96,6 +96,18 @@ func (s *CarSourceStore) AddSource(ctx context.Context, source config.BibSource)
 	return s.store.AddSource(ctx, source)
 }
 
+func (s *CarSourceStore) PreviousSource(ctx context.Context, directoryName string) (*config.BibEntryLocation, error) {
+	return s.store.PreviousSource(ctx, directoryName)
+}
+
+func (s *CarSourceStore) PreviousSourceNames() []string {
+	return s.store.PreviousSourceNames()
+}
+
+func (s *CarSourceStore) RemoveSource(ctx context.Context, directoryName string) error {
+	return s.store.RemoveSource(ctx, directoryName)
+}
+
 func (s *CarSourceStore) Finalize(ctx context.Context) (cid.Cid, error) {
 	rootCid, err := s.store.Finalize(ctx)
 	if err != nil {
@@ -1,7 +1,6 @@
 package store
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"github.com/frawleyskid/ipfs-bib/config"
@@ -10,17 +9,51 @@ import (
 	ipld "github.com/ipfs/go-ipld-format"
 	"github.com/ipfs/go-unixfs/importer"
 	unixfs "github.com/ipfs/go-unixfs/io"
+	"sort"
 )
 
 type dagSourceStore struct {
 	service   ipld.DAGService
 	directory unixfs.Directory
+	previous  map[string]cid.Cid
 }
 
-func newDagSourceStore(ctx context.Context, service ipld.DAGService) (*dagSourceStore, error) {
+func newDagSourceStore(ctx context.Context, service ipld.DAGService, previousRoot *string) (*dagSourceStore, error) {
 	directory := unixfs.NewDirectory(service)
 	directory.SetCidBuilder(DefaultCidPrefix)
 
+	previous := make(map[string]cid.Cid)
+
+	if previousRoot != nil {
+		rootCid, err := resolvePreviousRoot(ctx, service, *previousRoot)
+		if err != nil {
+			return nil, err
+		}
+
+		rootNode, err := service.Get(ctx, rootCid)
+		if err != nil {
+			return nil, fmt.Errorf("%w, %v", ErrIpfs, err)
+		}
+
+		directory, err = unixfs.NewDirectoryFromNode(service, rootNode)
+		if err != nil {
+			return nil, fmt.Errorf("%w, %v", ErrIpfs, err)
+		}
+
+		directory.SetCidBuilder(DefaultCidPrefix)
+
+		links, err := directory.Links(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%w, %v", ErrIpfs, err)
+		}
+
+		// We take a snapshot of the previous sources so that they can be
+		// looked up concurrently while the directory is being modified.
+		for _, link := range links {
+			previous[link.Name] = link.Cid
+		}
+	}
+
 	dirNode, err := directory.GetNode()
 	if err != nil {
 		return nil, fmt.Errorf("%w, %v", ErrIpfs, err)
@@ -33,20 +66,88 @@ func newDagSourceStore(ctx context.Context, service ipld.DAGService) (*dagSource
 	return &dagSourceStore{
 		service:   service,
 		directory: directory,
+		previous:  previous,
 	}, nil
 }
 
-func (s *dagSourceStore) AddSource(ctx context.Context, source config.BibSource) (config.BibEntryLocation, error) {
-	contentNode, err := importer.BuildDagFromReader(s.service, chunk.DefaultSplitter(bytes.NewReader(source.Content)))
+func (s *dagSourceStore) PreviousSource(ctx context.Context, directoryName string) (*config.BibEntryLocation, error) {
+	directoryCid, ok := s.previous[directoryName]
+	if !ok {
+		return nil, nil //nolint:nilnil
+	}
+
+	directoryNode, err := s.service.Get(ctx, directoryCid)
 	if err != nil {
-		return config.BibEntryLocation{}, fmt.Errorf("%w: %v", ErrIpfs, err)
+		return nil, fmt.Errorf("%w, %v", ErrIpfs, err)
 	}
 
+	links := directoryNode.Links()
+	if len(links) == 0 {
+		return nil, nil //nolint:nilnil
+	}
+
+	files := make([]config.BibFileLocation, len(links))
+	for index, link := range links {
+		files[index] = config.BibFileLocation{FileCid: link.Cid, FileName: link.Name}
+	}
+
+	location := &config.BibEntryLocation{
+		DirectoryCid:  directoryCid,
+		DirectoryName: directoryName,
+		Files:         files,
+	}
+
+	// A source directory contains more than one file when every attachment
+	// of an entry was archived. Which one is the main source isn't stored in
+	// the directory, so it's left to the caller.
+	if len(files) == 1 {
+		location.FileCid = files[0].FileCid
+		location.FileName = files[0].FileName
+	}
+
+	return location, nil
+}
+
+func (s *dagSourceStore) PreviousSourceNames() []string {
+	names := make([]string, 0, len(s.previous))
+	for name := range s.previous {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func (s *dagSourceStore) RemoveSource(ctx context.Context, directoryName string) error {
+	if err := s.directory.RemoveChild(ctx, directoryName); err != nil {
+		return fmt.Errorf("%w, %v", ErrIpfs, err)
+	}
+
+	return nil
+}
+
+func (s *dagSourceStore) AddSource(ctx context.Context, source config.BibSource) (config.BibEntryLocation, error) {
 	sourceDirectory := unixfs.NewDirectory(s.service)
 	sourceDirectory.SetCidBuilder(DefaultCidPrefix)
 
-	if err := sourceDirectory.AddChild(ctx, source.FileName, contentNode); err != nil {
-		return config.BibEntryLocation{}, err
+	files := make([]config.BibFileLocation, 0, len(source.Files))
+
+	for _, sourceFile := range source.Files {
+		contentNode, err := importer.BuildDagFromReader(s.service, chunk.DefaultSplitter(sourceFile.Content))
+		if err != nil {
+			return config.BibEntryLocation{}, fmt.Errorf("%w: %v", ErrIpfs, err)
+		}
+
+		if err := sourceDirectory.AddChild(ctx, sourceFile.FileName, contentNode); err != nil {
+			return config.BibEntryLocation{}, err
+		}
+
+		files = append(files, config.BibFileLocation{FileCid: contentNode.Cid(), FileName: sourceFile.FileName})
+	}
+
+	if len(files) == 0 {
+		return config.BibEntryLocation{}, fmt.Errorf("%w: %s", ErrNoSourceFiles, source.DirectoryName)
 	}
 
 	directoryNode, err := sourceDirectory.GetNode()
@@ -63,10 +164,11 @@ func (s *dagSourceStore) AddSource(ctx context.Context, source config.BibSource)
 	}
 
 	return config.BibEntryLocation{
-		FileCid:       contentNode.Cid(),
-		FileName:      source.FileName,
+		FileCid:       files[0].FileCid,
+		FileName:      files[0].FileName,
 		DirectoryCid:  directoryNode.Cid(),
 		DirectoryName: source.DirectoryName,
+		Files:         files,
 	}, nil
 }
 
@@ -22,6 +22,7 @@ type NodeSourceStoreOptions struct {
 	PinRemoteName   *string
 	PinningServices []config.Pin
 	MfsPath         *string
+	PreviousRoot    *string
 }
 
 func NewNodeSourceStore(ctx context.Context, apiUrl string, options NodeSourceStoreOptions) (*NodeSourceStore, error) {
@@ -32,7 +33,7 @@ func NewNodeSourceStore(ctx context.Context, apiUrl string, options NodeSourceSt
 
 	service := ipfsApi.Dag()
 
-	store, err := newDagSourceStore(ctx, service)
+	store, err := newDagSourceStore(ctx, service, options.PreviousRoot)
 	if err != nil {
 		return nil, err
 	}
@@ -52,6 +53,18 @@ func (s *NodeSourceStore) AddSource(ctx context.Context, source config.BibSource
 	return s.store.AddSource(ctx, source)
 }
 
+func (s *NodeSourceStore) PreviousSource(ctx context.Context, directoryName string) (*config.BibEntryLocation, error) {
+	return s.store.PreviousSource(ctx, directoryName)
+}
+
+func (s *NodeSourceStore) PreviousSourceNames() []string {
+	return s.store.PreviousSourceNames()
+}
+
+func (s *NodeSourceStore) RemoveSource(ctx context.Context, directoryName string) error {
+	return s.store.RemoveSource(ctx, directoryName)
+}
+
 func (s *NodeSourceStore) Finalize(ctx context.Context) (cid.Cid, error) {
 	rootCid, err := s.store.Finalize(ctx)
 	if err != nil {
@@ -11,13 +11,13 @@ type NullSourceStore struct {
 	service *LocalService
 }
 
-func NewNullSourceStore(ctx context.Context) (*NullSourceStore, error) {
+func NewNullSourceStore(ctx context.Context, previousRoot *string) (*NullSourceStore, error) {
 	service, err := NewLocalService()
 	if err != nil {
 		return nil, err
 	}
 
-	store, err := newDagSourceStore(ctx, service)
+	store, err := newDagSourceStore(ctx, service, previousRoot)
 	if err != nil {
 		return nil, err
 	}
@@ -32,6 +32,18 @@ func (s *NullSourceStore) AddSource(ctx context.Context, source config.BibSource
 	return s.store.AddSource(ctx, source)
 }
 
+func (s *NullSourceStore) PreviousSource(ctx context.Context, directoryName string) (*config.BibEntryLocation, error) {
+	return s.store.PreviousSource(ctx, directoryName)
+}
+
+func (s *NullSourceStore) PreviousSourceNames() []string {
+	return s.store.PreviousSourceNames()
+}
+
+func (s *NullSourceStore) RemoveSource(ctx context.Context, directoryName string) error {
+	return s.store.RemoveSource(ctx, directoryName)
+}
+
 func (s *NullSourceStore) Finalize(ctx context.Context) (cid.Cid, error) {
 	rootCid, err := s.store.Finalize(ctx)
 	if err != nil {
@@ -0,0 +1,74 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/frawleyskid/ipfs-bib/logging"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	gocarv2 "github.com/ipld/go-car/v2"
+	"io"
+	"os"
+)
+
+var ErrInvalidPreviousRoot = errors.New("previous root must be a CID or the path of a CAR archive")
+
+// LoadCar adds every block in a CARv1 or CARv2 archive to the DAG service and
+// returns the root of the archive.
+func LoadCar(ctx context.Context, service ipld.DAGService, path string) (cid.Cid, error) {
+	carFile, err := os.Open(path)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	defer func() {
+		if err := carFile.Close(); err != nil {
+			logging.Verbose.Println(err)
+		}
+	}()
+
+	blockReader, err := gocarv2.NewBlockReader(carFile)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("%w, %v", ErrIpfs, err)
+	}
+
+	if len(blockReader.Roots) != 1 {
+		return cid.Undef, fmt.Errorf("%w: CAR archive must have exactly one root", ErrInvalidPreviousRoot)
+	}
+
+	for {
+		block, err := blockReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return cid.Undef, fmt.Errorf("%w, %v", ErrIpfs, err)
+		}
+
+		node, err := ipld.Decode(block)
+		if err != nil {
+			return cid.Undef, fmt.Errorf("%w, %v", ErrIpfs, err)
+		}
+
+		if err := service.Add(ctx, node); err != nil {
+			return cid.Undef, fmt.Errorf("%w, %v", ErrIpfs, err)
+		}
+	}
+
+	return blockReader.Roots[0], nil
+}
+
+// resolvePreviousRoot accepts either a CID, which must already be available
+// to the DAG service, or the path of a CAR archive, which is loaded into the
+// DAG service.
+func resolvePreviousRoot(ctx context.Context, service ipld.DAGService, previousRoot string) (cid.Cid, error) {
+	if rootCid, err := cid.Decode(previousRoot); err == nil {
+		return rootCid, nil
+	}
+
+	if _, err := os.Stat(previousRoot); err != nil {
+		return cid.Undef, fmt.Errorf("%w: %s", ErrInvalidPreviousRoot, previousRoot)
+	}
+
+	return LoadCar(ctx, service, previousRoot)
+}
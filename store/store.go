@@ -10,23 +10,30 @@ import (
 
 var DefaultCidPrefix = dag.V1CidPrefix()
 
-var ErrIpfs = errors.New("ipfs error")
+var (
+	ErrIpfs          = errors.New("ipfs error")
+	ErrNoSourceFiles = errors.New("source has no files")
+)
 
 type SourceStore interface {
 	AddSource(ctx context.Context, source config.BibSource) (config.BibEntryLocation, error)
+	PreviousSource(ctx context.Context, directoryName string) (*config.BibEntryLocation, error)
+	PreviousSourceNames() []string
+	RemoveSource(ctx context.Context, directoryName string) error
 	Finalize(ctx context.Context) (cid.Cid, error)
 }
 
 func SourceStoreFromConfig(ctx context.Context, cfg config.Config) (SourceStore, error) {
 	switch {
 	case cfg.Flags.DryRun:
-		return NewNullSourceStore(ctx)
+		return NewNullSourceStore(ctx, cfg.Flags.MaybeUpdateFrom())
 	case cfg.Flags.MaybeCarPath() == nil:
 		options := NodeSourceStoreOptions{
 			PinLocal:        cfg.Flags.PinLocal,
 			PinRemoteName:   cfg.Flags.MaybePinRemoteName(),
 			PinningServices: cfg.File.Pins,
 			MfsPath:         cfg.Flags.MaybeMfsPath(),
+			PreviousRoot:    cfg.Flags.MaybeUpdateFrom(),
 		}
 
 		return NewNodeSourceStore(ctx, cfg.File.Ipfs.Api, options)
@@ -36,6 +43,6 @@ func SourceStoreFromConfig(ctx context.Context, cfg config.Config) (SourceStore,
 			return nil, err
 		}
 
-		return NewCarSourceStore(ctx, cfg.Flags.CarPath, isCarV2)
+		return NewCarSourceStore(ctx, cfg.Flags.CarPath, isCarV2, cfg.Flags.MaybeUpdateFrom())
 	}
 }